@@ -1,3 +1,4 @@
 from agent.clients.config_client import ConfigurationClient
+from agent.clients.service_token import ServiceTokenSource
 
-__all__ = ["ConfigurationClient"] 
\ No newline at end of file
+__all__ = ["ConfigurationClient", "ServiceTokenSource"] 
\ No newline at end of file
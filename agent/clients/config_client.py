@@ -2,15 +2,19 @@ import grpc
 import logging
 from typing import Optional
 from agent.protos import config_pb2, config_pb2_grpc
+from agent.clients.service_token import ServiceTokenSource
 from agent.utils.consul import ConsulClient
+from agent.utils.tls import secure_channel
 
 logging.basicConfig(level=logging.INFO)
 
 
 class ConfigurationClient:
-    def __init__(self, consul_client: ConsulClient, service_name: str = "configuration"):
+    def __init__(self, consul_client: ConsulClient, service_name: str = "configuration",
+                 token_source: Optional[ServiceTokenSource] = None):
         self.consul_client = consul_client
         self.service_name = service_name
+        self.token_source = token_source
         self.channel = None
         self.stub = None
 
@@ -22,7 +26,7 @@ class ConfigurationClient:
                 return False
 
             port = service_info[0]
-            self.channel = grpc.insecure_channel(port)
+            self.channel = secure_channel(port, self.service_name)
             self.stub = config_pb2_grpc.ConfigurationServiceStub(self.channel)
             logging.info("Successfully connected to service '%s' on port %s.",
                          self.service_name, port)
@@ -36,13 +40,19 @@ class ConfigurationClient:
             logging.error("Unexpected error during connect: %s", e)
             return False
 
-    def get_configuration(self, user_id: str) -> Optional[config_pb2.GetConfigurationResponse]:
+    def get_configuration(self, user_id: str, metadata=None) -> Optional[config_pb2.GetConfigurationResponse]:
         if not self.stub and not self.connect():
             return None
 
         try:
+            metadata = list(metadata or [])
+            if self.token_source:
+                token = self.token_source.get_token()
+                if token:
+                    metadata.append(("x-service-token", token))
+
             request = config_pb2.GetConfigurationRequest(user_id=user_id)
-            response = self.stub.GetConfigurationByUserID(request)
+            response = self.stub.GetConfigurationByUserID(request, metadata=metadata)
             logging.info("Configuration retrieved for user_id: %s", user_id)
             return response
 
@@ -0,0 +1,63 @@
+import os
+import time
+import logging
+from threading import Lock
+from typing import Optional
+from agent.protos import user_pb2, user_pb2_grpc
+from agent.utils.consul import ConsulClient
+from agent.utils.tls import secure_channel
+
+logger = logging.getLogger(__name__)
+
+
+class ServiceTokenSource:
+    """Obtains short-lived service tokens for this service from the user service.
+
+    The agent does not hold the shared service keys, so it proves its name with
+    its mTLS certificate or, without mTLS, AGENT_SERVICE_SECRET.
+    """
+
+    def __init__(self, consul_client: ConsulClient, audience: str, issuer_name: str = "user"):
+        self.consul_client = consul_client
+        self.audience = audience
+        self.issuer_name = issuer_name
+        self.client_id = os.getenv("AGENT_SERVICENAME", "agent")
+        self.client_secret = os.getenv("AGENT_SERVICE_SECRET", "")
+        self.stub = None
+        self.lock = Lock()
+        self.token = None
+        self.refresh_at = 0.0
+
+    def _connect(self) -> bool:
+        service_info = self.consul_client.discover(self.issuer_name)
+        if not service_info:
+            logger.error("Service '%s' not found in Consul.", self.issuer_name)
+            return False
+
+        channel = secure_channel(service_info[0], self.issuer_name)
+        self.stub = user_pb2_grpc.UserServiceStub(channel)
+        return True
+
+    def get_token(self) -> Optional[str]:
+        """Returns a cached token, renewing it once four fifths of its lifetime have passed."""
+        with self.lock:
+            if self.token and time.time() < self.refresh_at:
+                return self.token
+
+            try:
+                if not self.stub and not self._connect():
+                    return None
+
+                response = self.stub.IssueServiceToken(user_pb2.IssueServiceTokenRequest(
+                    client_id=self.client_id,
+                    client_secret=self.client_secret,
+                    audience=self.audience,
+                ))
+            except Exception as error:
+                logger.error("Failed to obtain service token for '%s': %s", self.audience, error)
+                self.stub = None
+                return None
+
+            self.token = response.token
+            self.refresh_at = time.time() + response.expires_in * 4 / 5
+            return self.token
@@ -6,6 +6,7 @@ from dotenv import load_dotenv
 
 from agent.service import serve
 from agent.utils import ConsulClient, health_check_loop, generate_instance_id
+from agent.utils.tracing import setup_tracing
 
 load_dotenv()
 
@@ -21,6 +22,8 @@ def main():
     instance_id = generate_instance_id(service_name)
     host_port = os.getenv("AGENT_ADDRESS")
 
+    setup_tracing(service_name)
+
     try:
         consul_client.register(instance_id, service_name, host_port)
         server = serve(host_port, consul_client)
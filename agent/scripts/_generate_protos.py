@@ -17,6 +17,7 @@ def generate_proto_files():
     proto_files = [
         os.path.join(PROTO_DIR, 'agent.proto'),
         os.path.join(PROTO_DIR, 'config.proto'),
+        os.path.join(PROTO_DIR, 'user.proto'),
     ]
 
     for proto_file in proto_files:
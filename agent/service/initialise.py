@@ -1,16 +1,23 @@
-from agent.clients import ConfigurationClient
+from agent.clients import ConfigurationClient, ServiceTokenSource
 from agent.service.service import AgentServicer
 from agent.protos import agent_pb2_grpc
+from agent.utils.tls import server_credentials
 import grpc
 from concurrent import futures
 
 def serve(address, consul_client):
     server = grpc.server(futures.ThreadPoolExecutor(max_workers=10))
 
-    configuration_service = ConfigurationClient(consul_client)
+    # The configuration service only returns decrypted API keys to the agent identity.
+    token_source = ServiceTokenSource(consul_client, audience="configuration")
+    configuration_service = ConfigurationClient(consul_client, token_source=token_source)
     agent_pb2_grpc.add_AgentServiceServicer_to_server(AgentServicer(configuration_service), server)
 
-    server.add_insecure_port(address)
+    credentials = server_credentials()
+    if credentials:
+        server.add_secure_port(address, credentials)
+    else:
+        server.add_insecure_port(address)
     server.start()
 
     return server
\ No newline at end of file
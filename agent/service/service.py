@@ -6,9 +6,11 @@ from typing import Dict, Any
 import time
 
 from agents import Runner, RunResult
+from opentelemetry import context as otel_context
 from agent.clients import ConfigurationClient
 from agent.models import create_agent_for_user
 from agent.protos import agent_pb2, agent_pb2_grpc
+from agent.utils.tracing import message_span
 
 logger = logging.getLogger(__name__)
 
@@ -27,6 +29,19 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
         self.cleanup_thread = threading.Thread(target=self._cleanup_inactive_conversations, daemon=True)
         self.cleanup_thread.start()
 
+    def _run(self, coro):
+        """Runs coro on the agent loop, carrying over the caller's trace context."""
+        ctx = otel_context.get_current()
+
+        async def with_context():
+            token = otel_context.attach(ctx)
+            try:
+                return await coro
+            finally:
+                otel_context.detach(token)
+
+        return asyncio.run_coroutine_threadsafe(with_context(), self.loop).result()
+
     def _run_loop(self):
         asyncio.set_event_loop(self.loop)
         self.loop.run_forever()
@@ -64,12 +79,12 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
 
         return result.final_output
 
-    async def _initialize_agent(self, user_id: str) -> str:
+    async def _initialize_agent(self, user_id: str, credentials=None) -> str:
         try:
             if not user_id or not isinstance(user_id, str) or not user_id.strip():
                 return "ERROR: Invalid user ID"
 
-            config = self.configuration_service.get_configuration(user_id)
+            config = self.configuration_service.get_configuration(user_id, metadata=credentials)
             if not config:
                 return f"ERROR: Configuration not found for user {user_id}"
 
@@ -98,8 +113,18 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
 
                 del self.user_conversations[user_id]
 
+    @staticmethod
+    def _forwarded_credentials(context):
+        """Returns the caller's user token so the configuration service can
+        authorize the lookup as that user."""
+        for key, value in context.invocation_metadata():
+            if key == "authorization":
+                return [(key, value)]
+        return None
+
     def AgentWebsocketStream(self, request_iterator, context):
         user_id = None
+        credentials = self._forwarded_credentials(context)
 
         for request in request_iterator:
             try:
@@ -120,10 +145,8 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
                 if request.type == agent_pb2.MessageType.INITIALIZE:
                     user_id = request.user_id
 
-                    result_future = asyncio.run_coroutine_threadsafe(
-                        self._initialize_agent(user_id), self.loop
-                    )
-                    result = result_future.result()
+                    with message_span("agent.initialize", request.metadata, user_id=user_id):
+                        result = self._run(self._initialize_agent(user_id, credentials))
 
                     message_type = (
                         agent_pb2.MessageType.ERROR
@@ -148,10 +171,8 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
                         continue
 
                     try:
-                        response_future = asyncio.run_coroutine_threadsafe(
-                            self._process_message(user_id, request.content), self.loop
-                        )
-                        response_text = response_future.result()
+                        with message_span("agent.message", request.metadata, user_id=user_id):
+                            response_text = self._run(self._process_message(user_id, request.content))
                         yield agent_pb2.AgentMessage(
                             type=agent_pb2.MessageType.AGENT_RESPONSE,
                             user_id=user_id,
@@ -175,10 +196,8 @@ class AgentServicer(agent_pb2_grpc.AgentServiceServicer):
                         )
 
                 elif request.type == agent_pb2.MessageType.CLOSE:
-                    close_future = asyncio.run_coroutine_threadsafe(
-                        self._close_agent(user_id), self.loop
-                    )
-                    close_future.result()
+                    with message_span("agent.close", request.metadata, user_id=user_id):
+                        self._run(self._close_agent(user_id))
                     yield agent_pb2.AgentMessage(
                         type=agent_pb2.MessageType.AGENT_RESPONSE,
                         user_id=user_id,
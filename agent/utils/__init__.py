@@ -1,3 +1,4 @@
 from agent.utils.consul import ConsulClient, health_check_loop, generate_instance_id
+from agent.utils.tls import server_credentials, secure_channel
 
-__all__ = ["ConsulClient", "health_check_loop", "generate_instance_id"]
\ No newline at end of file
+__all__ = ["ConsulClient", "health_check_loop", "generate_instance_id", "server_credentials", "secure_channel"]
\ No newline at end of file
@@ -0,0 +1,73 @@
+import os
+import logging
+from typing import Optional, Tuple
+
+import grpc
+
+logger = logging.getLogger(__name__)
+
+
+def _tls_paths() -> Optional[Tuple[str, str, str]]:
+    cert = os.getenv("AGENT_TLS_CERT_FILE")
+    key = os.getenv("AGENT_TLS_KEY_FILE")
+    ca = os.getenv("AGENT_TLS_CA_FILE")
+    if not (cert and key and ca):
+        return None
+    return cert, key, ca
+
+
+def _read(path: str) -> bytes:
+    with open(path, "rb") as f:
+        return f.read()
+
+
+def _mtimes(paths: Tuple[str, str, str]) -> Tuple[float, ...]:
+    return tuple(os.stat(path).st_mtime for path in paths)
+
+
+def server_credentials() -> Optional[grpc.ServerCredentials]:
+    paths = _tls_paths()
+    if not paths:
+        return None
+
+    cert, key, ca = paths
+    state = {"mtimes": _mtimes(paths)}
+
+    def load():
+        return grpc.ssl_server_certificate_configuration(
+            [(_read(key), _read(cert))], root_certificates=_read(ca)
+        )
+
+    def fetch():
+        try:
+            mtimes = _mtimes(paths)
+            if mtimes == state["mtimes"]:
+                return None
+            config = load()
+            state["mtimes"] = mtimes
+            logger.info("Reloaded TLS certificates")
+            return config
+        except Exception as e:
+            logger.error(f"Failed to reload TLS certificates: {e}")
+            return None
+
+    return grpc.dynamic_ssl_server_credentials(
+        load(), fetch, require_client_authentication=True
+    )
+
+
+def secure_channel(address: str, service_name: str) -> grpc.Channel:
+    paths = _tls_paths()
+    if not paths:
+        return grpc.insecure_channel(address)
+
+    cert, key, ca = paths
+    credentials = grpc.ssl_channel_credentials(
+        root_certificates=_read(ca),
+        private_key=_read(key),
+        certificate_chain=_read(cert),
+    )
+    # Instances are discovered by address, so verify the service name SAN instead.
+    return grpc.secure_channel(
+        address, credentials, options=[("grpc.ssl_target_name_override", service_name)]
+    )
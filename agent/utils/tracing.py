@@ -0,0 +1,49 @@
+import os
+import logging
+from contextlib import contextmanager
+from typing import Mapping
+
+from opentelemetry import trace, propagate
+from opentelemetry.sdk.resources import Resource
+from opentelemetry.sdk.trace import TracerProvider
+from opentelemetry.sdk.trace.export import BatchSpanProcessor, ConsoleSpanExporter
+from opentelemetry.instrumentation.grpc import GrpcInstrumentorClient, GrpcInstrumentorServer
+
+logger = logging.getLogger(__name__)
+tracer = trace.get_tracer("agent")
+
+
+def setup_tracing(service_name: str) -> None:
+    GrpcInstrumentorServer().instrument()
+    GrpcInstrumentorClient().instrument()
+
+    exporter_name = os.getenv("AGENT_TRACE_EXPORTER", "none")
+    if exporter_name == "none":
+        return
+
+    if exporter_name == "otlp":
+        from opentelemetry.exporter.otlp.proto.grpc.trace_exporter import OTLPSpanExporter
+
+        exporter = OTLPSpanExporter(
+            endpoint=os.getenv("AGENT_TRACE_ENDPOINT"),
+            insecure=os.getenv("AGENT_TRACE_INSECURE", "").lower() == "true",
+        )
+    elif exporter_name == "stdout":
+        exporter = ConsoleSpanExporter()
+    else:
+        logger.error(f"Unknown trace exporter: {exporter_name}")
+        return
+
+    provider = TracerProvider(resource=Resource.create({"service.name": service_name}))
+    provider.add_span_processor(BatchSpanProcessor(exporter))
+    trace.set_tracer_provider(provider)
+
+
+@contextmanager
+def message_span(name: str, metadata: Mapping[str, str], **attributes):
+    """Starts a span parented to the trace context the gateway injected into the message metadata."""
+    ctx = propagate.extract(dict(metadata))
+    with tracer.start_as_current_span(name, context=ctx, kind=trace.SpanKind.CONSUMER) as span:
+        for key, value in attributes.items():
+            span.set_attribute(key, value)
+        yield span
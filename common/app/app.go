@@ -0,0 +1,336 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	common "github.com/HJyup/mtl-common"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/interceptor"
+	"github.com/HJyup/mtl-common/mtls"
+	"github.com/HJyup/mtl-common/registry"
+	"github.com/HJyup/mtl-common/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	DefaultDrainTimeout    = 15 * time.Second
+	DefaultDeregisterDelay = 2 * time.Second
+)
+
+type Options struct {
+	ServiceName  string
+	Address      string
+	Registry     string
+	RegistryFile string
+	Consul       string
+	TLS          mtls.Config
+	Tracing      tracing.Config
+	// MetricsAddress serves Prometheus metrics on /metrics when set.
+	MetricsAddress string
+	// ServiceKeys, shared by all services, sign and verify service identity
+	// tokens. Service tokens are disabled when no key is configured.
+	ServiceKeys auth.KeyringConfig
+
+	// DeregisterDelay is how long to wait after leaving the registry before
+	// draining, so that clients watching the registry stop picking this instance.
+	DeregisterDelay time.Duration
+	// DrainTimeout bounds the total time given to stop hooks.
+	DrainTimeout time.Duration
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+type runner struct {
+	name string
+	fn   func() error
+}
+
+// App owns the lifecycle of a service binary: start hooks run in order, the
+// instance is registered once its servers are up, and on SIGINT/SIGTERM it is
+// marked unhealthy and deregistered before stop hooks run in reverse order.
+type App struct {
+	options    Options
+	logger     *zap.Logger
+	registry   common.Registry
+	instanceID string
+	health     *common.HealthMonitor
+	tls        *mtls.Source
+	identity   *auth.ServiceIdentity
+
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	stopSignals context.CancelFunc
+
+	startHooks []hook
+	stopHooks  []hook
+	runners    []runner
+}
+
+func New(options Options) (*App, error) {
+	if options.DeregisterDelay == 0 {
+		options.DeregisterDelay = DefaultDeregisterDelay
+	}
+	if options.DrainTimeout == 0 {
+		options.DrainTimeout = DefaultDrainTimeout
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, fmt.Errorf("create logger: %w", err)
+	}
+
+	reg, err := registry.New(options.Registry, options.Consul, options.RegistryFile)
+	if err != nil {
+		return nil, fmt.Errorf("create registry: %w", err)
+	}
+
+	var identity *auth.ServiceIdentity
+	var serviceKeys *auth.Keyring
+	if keys := options.ServiceKeys; keys.KeysFile != "" || keys.Secret != "" || keys.PrivateKeyFile != "" {
+		if serviceKeys, err = auth.NewKeyring(keys); err != nil {
+			return nil, fmt.Errorf("load service keys: %w", err)
+		}
+		identity = auth.NewServiceIdentity(options.ServiceName, serviceKeys, auth.DefaultServiceTokenTTL)
+	}
+
+	var source *mtls.Source
+	if options.TLS.Enabled() {
+		if source, err = mtls.NewSource(options.TLS); err != nil {
+			return nil, fmt.Errorf("load tls: %w", err)
+		}
+	}
+
+	if options.Tracing.ServiceName == "" {
+		options.Tracing.ServiceName = options.ServiceName
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), options.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("setup tracing: %w", err)
+	}
+
+	instanceID := common.GenerateInstanceID(options.ServiceName)
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancelCause(signalCtx)
+
+	a := &App{
+		options:     options,
+		logger:      logger,
+		registry:    reg,
+		instanceID:  instanceID,
+		health:      common.NewHealthMonitor(reg, instanceID),
+		tls:         source,
+		identity:    identity,
+		ctx:         ctx,
+		cancel:      cancel,
+		stopSignals: stopSignals,
+	}
+	// Registered first so that it runs last and flushes spans from every other hook.
+	a.OnStop("tracing", shutdownTracing)
+
+	if serviceKeys != nil {
+		a.Go("service keys", func() error {
+			serviceKeys.Run(a.ctx)
+			return nil
+		})
+	}
+
+	if options.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		a.serveHTTP("metrics", options.MetricsAddress, &http.Server{Handler: mux})
+	}
+
+	return a, nil
+}
+
+func (a *App) Context() context.Context {
+	return a.ctx
+}
+
+func (a *App) Logger() *zap.Logger {
+	return a.logger
+}
+
+func (a *App) Registry() common.Registry {
+	return a.registry
+}
+
+func (a *App) Health() *common.HealthMonitor {
+	return a.health
+}
+
+// ServiceIdentity mints and verifies service tokens, or is nil when no service
+// keys are configured.
+func (a *App) ServiceIdentity() *auth.ServiceIdentity {
+	return a.identity
+}
+
+// ServerOptions returns the gRPC server options implied by the app options:
+// tracing, metrics, request IDs, and mTLS credentials requiring a client certificate when
+// TLS is set.
+func (a *App) ServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(interceptor.UnaryServerMetrics(), interceptor.UnaryServerRequestID(a.logger)),
+		grpc.ChainStreamInterceptor(interceptor.StreamServerMetrics(), interceptor.StreamServerRequestID(a.logger)),
+	}
+	if a.tls != nil {
+		opts = append(opts, grpc.Creds(a.tls.ServerCredentials()))
+	}
+	return opts
+}
+
+func (a *App) ClientCredentials(serviceName string) credentials.TransportCredentials {
+	return mtls.ClientCredentials(a.tls, serviceName)
+}
+
+func (a *App) OnStart(name string, fn func(ctx context.Context) error) {
+	a.startHooks = append(a.startHooks, hook{name: name, fn: fn})
+}
+
+func (a *App) OnStop(name string, fn func(ctx context.Context) error) {
+	a.stopHooks = append(a.stopHooks, hook{name: name, fn: fn})
+}
+
+// Go runs fn for the lifetime of the app. If it returns an error the app
+// shuts down.
+func (a *App) Go(name string, fn func() error) {
+	a.runners = append(a.runners, runner{name: name, fn: fn})
+}
+
+func (a *App) ServeGRPC(server *grpc.Server) {
+	var lis net.Listener
+	a.OnStart("grpc listener", func(context.Context) error {
+		var err error
+		lis, err = net.Listen("tcp", a.options.Address)
+		return err
+	})
+	a.Go("grpc server", func() error {
+		a.logger.Info("Starting gRPC server", zap.String("address", a.options.Address))
+		return server.Serve(lis)
+	})
+	a.OnStop("grpc server", func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			server.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+func (a *App) ServeHTTP(server *http.Server) {
+	a.serveHTTP("http", a.options.Address, server)
+}
+
+func (a *App) serveHTTP(name, address string, server *http.Server) {
+	var lis net.Listener
+	a.OnStart(name+" listener", func(context.Context) error {
+		var err error
+		lis, err = net.Listen("tcp", address)
+		return err
+	})
+	a.Go(name+" server", func() error {
+		a.logger.Info("Starting HTTP server", zap.String("name", name), zap.String("address", address))
+		if err := server.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	a.OnStop(name+" server", func(ctx context.Context) error {
+		return server.Shutdown(ctx)
+	})
+}
+
+// Run starts the app and blocks until it is signalled to stop or a runner
+// fails, then performs an ordered shutdown.
+func (a *App) Run() error {
+	defer a.stopSignals()
+	defer func() {
+		_ = a.logger.Sync()
+	}()
+
+	for _, h := range a.startHooks {
+		if err := h.fn(a.ctx); err != nil {
+			return errors.Join(fmt.Errorf("start %s: %w", h.name, err), a.shutdown(false))
+		}
+	}
+
+	errs := make(chan error, len(a.runners))
+	for _, r := range a.runners {
+		go func() {
+			if err := r.fn(); err != nil {
+				err = fmt.Errorf("%s: %w", r.name, err)
+				errs <- err
+				a.cancel(err)
+			}
+		}()
+	}
+
+	if err := a.registry.Register(a.instanceID, a.options.ServiceName, a.options.Address); err != nil {
+		return errors.Join(fmt.Errorf("register service: %w", err), a.shutdown(false))
+	}
+	go a.health.Run(a.ctx)
+	if a.tls != nil {
+		go a.tls.Run(a.ctx)
+	}
+
+	<-a.ctx.Done()
+	a.logger.Info("Shutting down", zap.NamedError("cause", context.Cause(a.ctx)))
+
+	shutdownErr := a.shutdown(true)
+	select {
+	case err := <-errs:
+		return errors.Join(err, shutdownErr)
+	default:
+		return shutdownErr
+	}
+}
+
+func (a *App) shutdown(registered bool) error {
+	a.cancel(context.Canceled)
+	a.health.Shutdown()
+
+	if registered {
+		if err := a.registry.DeRegister(a.instanceID); err != nil {
+			a.logger.Warn("Failed to deregister service", zap.Error(err))
+		}
+		time.Sleep(a.options.DeregisterDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.options.DrainTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(a.stopHooks) - 1; i >= 0; i-- {
+		h := a.stopHooks[i]
+		if err := h.fn(ctx); err != nil {
+			a.logger.Error("Failed to stop", zap.String("hook", h.name), zap.Error(err))
+			errs = append(errs, fmt.Errorf("stop %s: %w", h.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// RevocationsKey is bumped in the registry KV whenever a token is revoked.
+	RevocationsKey = "mtl/auth/revocations"
+
+	denylistPollInterval = 30 * time.Second
+	// denylistSyncOverlap re-fetches a little history on every sync so that
+	// revocations committed slightly out of order are not missed.
+	denylistSyncOverlap = 5 * time.Second
+)
+
+type Revocation struct {
+	TokenID   string
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+// RevocationFetcher returns revocations recorded after since that have not
+// expired yet.
+type RevocationFetcher func(ctx context.Context, since time.Time) ([]Revocation, error)
+
+// Revocations reports whether a token has been revoked before its expiry.
+type Revocations interface {
+	Revoked(tokenID string) bool
+}
+
+// Denylist mirrors the issuer's revoked token IDs in memory. It syncs whenever
+// the revocations key changes and polls as a fallback, so registries without
+// a KV still converge. Until the first sync succeeds nothing is denied.
+type Denylist struct {
+	fetch RevocationFetcher
+
+	mu          sync.RWMutex
+	revoked     map[string]time.Time
+	since       time.Time
+	subscribers map[string][]chan struct{}
+}
+
+func NewDenylist(fetch RevocationFetcher) *Denylist {
+	return &Denylist{
+		fetch:       fetch,
+		revoked:     make(map[string]time.Time),
+		subscribers: make(map[string][]chan struct{}),
+	}
+}
+
+// Run keeps the denylist in sync until ctx is done. changes may be nil.
+func (d *Denylist) Run(ctx context.Context, changes <-chan []byte) {
+	ticker := time.NewTicker(denylistPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to sync token denylist: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+			}
+		}
+	}
+}
+
+func (d *Denylist) Revoked(tokenID string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.revoked[tokenID]
+	return ok
+}
+
+// Add records a revocation locally, ahead of the next sync.
+func (d *Denylist) Add(tokenID string, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.add(tokenID, expiresAt)
+}
+
+// Subscribe returns a channel that is closed when tokenID is revoked, so that
+// long-lived connections authenticated with it can be terminated.
+func (d *Denylist) Subscribe(tokenID string) (<-chan struct{}, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan struct{})
+	if _, ok := d.revoked[tokenID]; ok {
+		close(ch)
+		return ch, func() {}
+	}
+	d.subscribers[tokenID] = append(d.subscribers[tokenID], ch)
+
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		subs := d.subscribers[tokenID]
+		for i, sub := range subs {
+			if sub == ch {
+				subs = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(subs) == 0 {
+			delete(d.subscribers, tokenID)
+		} else {
+			d.subscribers[tokenID] = subs
+		}
+	}
+}
+
+func (d *Denylist) sync(ctx context.Context) error {
+	d.mu.RLock()
+	since := d.since
+	d.mu.RUnlock()
+
+	revocations, err := d.fetch(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for tokenID, expiresAt := range d.revoked {
+		if now.After(expiresAt) {
+			delete(d.revoked, tokenID)
+		}
+	}
+	for _, revocation := range revocations {
+		d.add(revocation.TokenID, revocation.ExpiresAt)
+		if revokedAt := revocation.RevokedAt.Add(-denylistSyncOverlap); revokedAt.After(d.since) {
+			d.since = revokedAt
+		}
+	}
+
+	return nil
+}
+
+// add must be called with d.mu held.
+func (d *Denylist) add(tokenID string, expiresAt time.Time) {
+	d.revoked[tokenID] = expiresAt
+	for _, ch := range d.subscribers[tokenID] {
+		close(ch)
+	}
+	delete(d.subscribers, tokenID)
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/HJyup/mtl-common/api"
+)
+
+// UserServiceJWKS fetches the token issuer's public keys from the user service.
+func UserServiceJWKS(client pb.UserServiceClient) JWKSFetcher {
+	return func(ctx context.Context) (*JWKS, error) {
+		resp, err := client.GetJWKS(ctx, &pb.GetJWKSRequest{})
+		if err != nil {
+			return nil, err
+		}
+
+		set := &JWKS{Keys: make([]JWK, 0, len(resp.Keys))}
+		for _, key := range resp.Keys {
+			set.Keys = append(set.Keys, JWK{
+				KeyID:     key.Kid,
+				KeyType:   key.Kty,
+				Algorithm: key.Alg,
+				Use:       key.Use,
+				N:         key.N,
+				E:         key.E,
+				Curve:     key.Crv,
+				X:         key.X,
+			})
+		}
+
+		return set, nil
+	}
+}
+
+// UserServiceRevocations fetches revoked token IDs from the user service.
+func UserServiceRevocations(client pb.UserServiceClient) RevocationFetcher {
+	return func(ctx context.Context, since time.Time) ([]Revocation, error) {
+		var sinceMillis int64
+		if !since.IsZero() {
+			sinceMillis = since.UnixMilli()
+		}
+
+		resp, err := client.ListRevokedTokens(ctx, &pb.ListRevokedTokensRequest{Since: sinceMillis})
+		if err != nil {
+			return nil, err
+		}
+
+		revocations := make([]Revocation, 0, len(resp.Tokens))
+		for _, token := range resp.Tokens {
+			revocations = append(revocations, Revocation{
+				TokenID:   token.TokenId,
+				ExpiresAt: time.Unix(token.ExpiresAt, 0),
+				RevokedAt: time.UnixMilli(token.RevokedAt),
+			})
+		}
+
+		return revocations, nil
+	}
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	DefaultJWKSRefreshInterval = 5 * time.Minute
+
+	// minJWKSRefreshInterval rate-limits refreshes triggered by tokens with an
+	// unknown kid, so garbage tokens cannot hammer the issuer.
+	minJWKSRefreshInterval = 30 * time.Second
+	jwksFetchTimeout       = 5 * time.Second
+)
+
+// JWK is a public key in RFC 7517 form. Only RSA and Ed25519 keys are used.
+type JWK struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newJWK(keyID, algorithm string, public interface{}) (JWK, bool) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyID:     keyID,
+			KeyType:   "RSA",
+			Algorithm: algorithm,
+			Use:       "sig",
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			KeyID:     keyID,
+			KeyType:   "OKP",
+			Algorithm: algorithm,
+			Use:       "sig",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key),
+		}, true
+	default:
+		return JWK{}, false
+	}
+}
+
+func (k JWK) verificationKey() (signingKey, error) {
+	if k.Use == "enc" {
+		return signingKey{}, errors.New("encryption key")
+	}
+
+	switch {
+	// alg is optional; OpenID providers that leave it out sign with RS256.
+	case k.KeyType == "RSA" && (k.Algorithm == AlgorithmRS256 || k.Algorithm == ""):
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return signingKey{}, fmt.Errorf("decode n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return signingKey{}, fmt.Errorf("decode e: %w", err)
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return signingKey{method: jwt.SigningMethodRS256, verify: public}, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519" && k.Algorithm == AlgorithmEdDSA:
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return signingKey{}, fmt.Errorf("decode x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return signingKey{}, errors.New("invalid ed25519 public key size")
+		}
+		return signingKey{method: jwt.SigningMethodEdDSA, verify: ed25519.PublicKey(x)}, nil
+	default:
+		return signingKey{}, fmt.Errorf("unsupported key type %q with algorithm %q", k.KeyType, k.Algorithm)
+	}
+}
+
+type JWKSFetcher func(ctx context.Context) (*JWKS, error)
+
+// JWKSCache verifies tokens against a key set fetched from the issuer. The set
+// is refreshed periodically by Run, and on demand when a token names a key
+// that is not cached yet, which is what happens right after a rotation.
+type JWKSCache struct {
+	fetch    JWKSFetcher
+	interval time.Duration
+
+	refreshMu   sync.Mutex
+	lastAttempt time.Time
+
+	mu   sync.RWMutex
+	set  *JWKS
+	keys map[string]signingKey
+}
+
+func NewJWKSCache(fetch JWKSFetcher, interval time.Duration) *JWKSCache {
+	if interval <= 0 {
+		interval = DefaultJWKSRefreshInterval
+	}
+	return &JWKSCache{
+		fetch:    fetch,
+		interval: interval,
+		set:      &JWKS{Keys: []JWK{}},
+		keys:     map[string]signingKey{},
+	}
+}
+
+func (c *JWKSCache) Run(ctx context.Context) {
+	if err := c.refresh(ctx); err != nil {
+		log.Printf("Failed to fetch JWKS: %v", err)
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.refresh(ctx); err != nil {
+				log.Printf("Failed to refresh JWKS: %v", err)
+			}
+		}
+	}
+}
+
+// JWKS returns the cached key set, for republishing.
+func (c *JWKSCache) JWKS() *JWKS {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.set
+}
+
+func (c *JWKSCache) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, c.keyFunc)
+}
+
+func (c *JWKSCache) keyFunc(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	if keyID == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	key, ok := c.lookup(keyID)
+	if !ok {
+		c.refreshMu.Lock()
+		if time.Since(c.lastAttempt) >= minJWKSRefreshInterval {
+			ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+			if err := c.refreshLocked(ctx); err != nil {
+				log.Printf("Failed to refresh JWKS for unknown key %q: %v", keyID, err)
+			}
+			cancel()
+		}
+		c.refreshMu.Unlock()
+
+		if key, ok = c.lookup(keyID); !ok {
+			return nil, ErrUnknownKeyID
+		}
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verify, nil
+}
+
+func (c *JWKSCache) lookup(keyID string) (signingKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key, ok := c.keys[keyID]
+	return key, ok
+}
+
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	return c.refreshLocked(ctx)
+}
+
+func (c *JWKSCache) refreshLocked(ctx context.Context) error {
+	c.lastAttempt = time.Now()
+
+	set, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]signingKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.verificationKey()
+		if err != nil {
+			log.Printf("Skipping JWK %q: %v", jwk.KeyID, err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	c.mu.Lock()
+	c.set = set
+	c.keys = keys
+	c.mu.Unlock()
+
+	return nil
+}
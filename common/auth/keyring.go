@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	reloadInterval = 10 * time.Second
+	minSecretLen   = 32
+
+	DefaultKeyID = "default"
+
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	ErrMissingKeyID = errors.New("token has no key id")
+	ErrUnknownKeyID = errors.New("token signed with unknown key")
+)
+
+// Verifier parses and validates a signed token into claims. It is implemented
+// by Keyring, which can also sign, and by JWKSCache, which cannot.
+type Verifier interface {
+	Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error)
+}
+
+type KeyringConfig struct {
+	// KeysFile is a YAML or JSON file in the KeysFile layout, re-read whenever
+	// it changes on disk.
+	KeysFile string
+	// Algorithm, Secret, PrivateKeyFile and KeyID configure a single static key
+	// when KeysFile is not set. Secret is used for HS256, PrivateKeyFile (PEM)
+	// for RS256 and EdDSA.
+	Algorithm      string
+	Secret         string
+	PrivateKeyFile string
+	KeyID          string
+}
+
+// KeysFile is the on-disk layout, e.g.
+//
+//	current: "2025-02"
+//	keys:
+//	  - id: "2025-02"
+//	    algorithm: "EdDSA"
+//	    private_key_file: "jwt-2025-02.pem"
+//	  - id: "2025-01"
+//	    algorithm: "HS256"
+//	    secret: "..."
+//
+// Relative private key paths are resolved against the directory of the keys
+// file. To rotate without logging everybody out: add the new key to the file,
+// wait for verifiers to pick it up (via JWKS for asymmetric keys), point
+// current at it, and remove the old key once the longest-lived token signed
+// with it has expired.
+type KeysFile struct {
+	Current string          `json:"current" yaml:"current"`
+	Keys    []KeysFileEntry `json:"keys" yaml:"keys"`
+}
+
+type KeysFileEntry struct {
+	ID             string `json:"id" yaml:"id"`
+	Algorithm      string `json:"algorithm" yaml:"algorithm"`
+	Secret         string `json:"secret" yaml:"secret"`
+	PrivateKeyFile string `json:"private_key_file" yaml:"private_key_file"`
+}
+
+type signingKey struct {
+	method jwt.SigningMethod
+	// sign is the HMAC secret or private key; verify the secret or public key.
+	sign   interface{}
+	verify interface{}
+}
+
+// Keyring signs tokens with the current key and verifies tokens signed with
+// any key it holds, selected by the kid header.
+type Keyring struct {
+	path string
+
+	mu      sync.RWMutex
+	current string
+	keys    map[string]signingKey
+	modTime time.Time
+}
+
+func NewKeyring(config KeyringConfig) (*Keyring, error) {
+	if config.KeysFile != "" {
+		k := &Keyring{path: config.KeysFile}
+		if err := k.reload(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+
+	keyID := config.KeyID
+	if keyID == "" {
+		keyID = DefaultKeyID
+	}
+	key, err := loadKey(KeysFileEntry{
+		ID:             keyID,
+		Algorithm:      config.Algorithm,
+		Secret:         config.Secret,
+		PrivateKeyFile: config.PrivateKeyFile,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keyring{
+		current: keyID,
+		keys:    map[string]signingKey{keyID: key},
+	}, nil
+}
+
+// Run reloads the keys file until ctx is done. It is a no-op for a static key.
+func (k *Keyring) Run(ctx context.Context) {
+	if k.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reload(); err != nil {
+				log.Printf("Failed to reload JWT keys file %s: %v", k.path, err)
+			}
+		}
+	}
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	keyID, key := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(key.sign)
+}
+
+func (k *Keyring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, k.keyFunc)
+}
+
+// JWKS returns the public halves of the asymmetric keys in the ring. HMAC keys
+// are never published.
+func (k *Keyring) JWKS() *JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := &JWKS{Keys: []JWK{}}
+	for keyID, key := range k.keys {
+		if jwk, ok := newJWK(keyID, key.method.Alg(), key.verify); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+
+	return set
+}
+
+func (k *Keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	if keyID == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[keyID]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	// The key, not the token, decides the algorithm.
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verify, nil
+}
+
+func (k *Keyring) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	var file KeysFile
+	if filepath.Ext(k.path) == ".json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", k.path, err)
+	}
+
+	keys := make(map[string]signingKey, len(file.Keys))
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return fmt.Errorf("parse %s: key without id", k.path)
+		}
+		key, err := loadKey(entry, filepath.Dir(k.path))
+		if err != nil {
+			return fmt.Errorf("parse %s: key %q: %w", k.path, entry.ID, err)
+		}
+		keys[entry.ID] = key
+	}
+	if _, ok := keys[file.Current]; !ok {
+		return fmt.Errorf("parse %s: current key %q not found", k.path, file.Current)
+	}
+
+	k.mu.Lock()
+	k.current = file.Current
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.mu.Unlock()
+
+	return nil
+}
+
+func loadKey(entry KeysFileEntry, dir string) (signingKey, error) {
+	switch entry.Algorithm {
+	case "", AlgorithmHS256:
+		if len(entry.Secret) < minSecretLen {
+			return signingKey{}, fmt.Errorf("jwt secret must be at least %d bytes", minSecretLen)
+		}
+		secret := []byte(entry.Secret)
+		return signingKey{method: jwt.SigningMethodHS256, sign: secret, verify: secret}, nil
+	case AlgorithmRS256, AlgorithmEdDSA:
+		path := entry.PrivateKeyFile
+		if path == "" {
+			return signingKey{}, fmt.Errorf("%s requires a private key file", entry.Algorithm)
+		}
+		if dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		pemData, err := os.ReadFile(path)
+		if err != nil {
+			return signingKey{}, fmt.Errorf("read private key: %w", err)
+		}
+
+		if entry.Algorithm == AlgorithmRS256 {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+			if err != nil {
+				return signingKey{}, fmt.Errorf("parse rsa private key: %w", err)
+			}
+			return signingKey{method: jwt.SigningMethodRS256, sign: private, verify: &private.PublicKey}, nil
+		}
+
+		private, err := jwt.ParseEdPrivateKeyFromPEM(pemData)
+		if err != nil {
+			return signingKey{}, fmt.Errorf("parse ed25519 private key: %w", err)
+		}
+		return signingKey{method: jwt.SigningMethodEdDSA, sign: private, verify: private.(ed25519.PrivateKey).Public()}, nil
+	default:
+		return signingKey{}, fmt.Errorf("unsupported jwt algorithm %q", entry.Algorithm)
+	}
+}
+
+// Verifiers tries each verifier in turn. The gateway uses it to accept tokens
+// from the issuer's JWKS and, while migrating off HS256, a shared keyring.
+type Verifiers []Verifier
+
+func (v Verifiers) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	err := ErrUnknownKeyID
+	for _, verifier := range v {
+		var token *jwt.Token
+		if token, err = verifier.Parse(tokenString, claims); err == nil {
+			return token, nil
+		}
+	}
+	return nil, err
+}
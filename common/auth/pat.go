@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PersonalAccessTokenPrefix tells personal access tokens apart from JWTs
+	// and makes them easy to spot in secret scanners.
+	PersonalAccessTokenPrefix = "mtlpat_"
+
+	// exchangedTokenMargin stops handing out cached access tokens shortly
+	// before they expire, so they do not expire in flight.
+	exchangedTokenMargin = 30 * time.Second
+)
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// PersonalAccessTokenExchanger trades a personal access token for a
+// short-lived access token, returning it with its expiry.
+type PersonalAccessTokenExchanger func(ctx context.Context, token string) (string, time.Time, error)
+
+type exchangedToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// PersonalAccessTokens caches exchanged access tokens, so that a script making
+// many requests costs one exchange per access token lifetime. A revoked
+// personal access token stays cached, but its ID is the sid of the access
+// token and so is caught by the denylist.
+type PersonalAccessTokens struct {
+	exchange PersonalAccessTokenExchanger
+
+	mu    sync.Mutex
+	cache map[string]exchangedToken
+}
+
+func NewPersonalAccessTokens(exchange PersonalAccessTokenExchanger) *PersonalAccessTokens {
+	return &PersonalAccessTokens{exchange: exchange, cache: map[string]exchangedToken{}}
+}
+
+// AccessToken returns an access token for the personal access token.
+func (p *PersonalAccessTokens) AccessToken(ctx context.Context, token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	p.mu.Lock()
+	cached, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt.Add(-exchangedTokenMargin)) {
+		return cached.accessToken, nil
+	}
+
+	accessToken, expiresAt, err := p.exchange(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for k, entry := range p.cache {
+		if now.After(entry.expiresAt) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = exchangedToken{accessToken: accessToken, expiresAt: expiresAt}
+	p.mu.Unlock()
+
+	return accessToken, nil
+}
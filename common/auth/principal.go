@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// RoleAdmin is granted to operators, who may manage any user's account.
+const RoleAdmin = "admin"
+
+var (
+	ErrUnauthenticated  = errors.New("caller is not authenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Principal is the verified caller of an RPC. UserID is set when the call
+// carries a user token, Service when it carries a service identity token; a
+// service forwarding a user's request has both.
+type Principal struct {
+	UserID    string
+	SessionID string
+	TokenID   string
+	// Roles and Scopes come from the user token; services have neither.
+	Roles  []string
+	Scopes []string
+
+	Service string
+	// Trusted is set for services allowed to act on behalf of any user.
+	Trusted bool
+}
+
+type principalKey struct{}
+
+type tokenKey struct{}
+
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal set by the server auth interceptor, or nil.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// NewTokenContext stores the caller's raw user token so that outgoing RPCs can
+// forward it.
+func NewTokenContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+func TokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// CanAccessUser reports whether the principal may read or change userID's
+// data. A user token always pins the call to its own user, even when a
+// trusted service forwards it.
+func (p *Principal) CanAccessUser(userID string) bool {
+	if p == nil {
+		return false
+	}
+	if p.UserID != "" {
+		return p.UserID == userID
+	}
+	return p.Trusted
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && p.UserID != "" && slices.Contains(p.Roles, role)
+}
+
+// AuthorizeUser returns ErrPermissionDenied unless the caller in ctx may act
+// on userID.
+func AuthorizeUser(ctx context.Context, userID string) error {
+	principal := FromContext(ctx)
+	if principal == nil {
+		return ErrUnauthenticated
+	}
+	if !principal.CanAccessUser(userID) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// AuthorizeRole returns ErrPermissionDenied unless the user in ctx has role.
+func AuthorizeRole(ctx context.Context, role string) error {
+	principal := FromContext(ctx)
+	if principal == nil {
+		return ErrUnauthenticated
+	}
+	if !principal.HasRole(role) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// AuthorizeTrustedService returns ErrPermissionDenied unless the caller is a
+// trusted service acting on its own behalf rather than forwarding a user.
+func AuthorizeTrustedService(ctx context.Context) error {
+	principal := FromContext(ctx)
+	if principal == nil {
+		return ErrUnauthenticated
+	}
+	if principal.UserID != "" || !principal.Trusted {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// AuthorizeUserOrRole is AuthorizeUser, also letting through users with role.
+func AuthorizeUserOrRole(ctx context.Context, userID, role string) error {
+	if err := AuthorizeUser(ctx, userID); !errors.Is(err, ErrPermissionDenied) {
+		return err
+	}
+	return AuthorizeRole(ctx, role)
+}
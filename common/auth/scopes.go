@@ -0,0 +1,23 @@
+package auth
+
+import "slices"
+
+// Scopes limit what a personal access token may do. Tokens from an interactive
+// sign in carry no scopes and are not limited by them.
+const (
+	ScopeConfigRead  = "config:read"
+	ScopeConfigWrite = "config:write"
+	ScopeAgentChat   = "agent:chat"
+	ScopeUsersRead   = "users:read"
+)
+
+var scopes = []string{ScopeConfigRead, ScopeConfigWrite, ScopeAgentChat, ScopeUsersRead}
+
+func ValidScope(scope string) bool {
+	return slices.Contains(scopes, scope)
+}
+
+// HasScope reports whether a token with granted scopes may be used for scope.
+func HasScope(granted []string, scope string) bool {
+	return len(granted) == 0 || slices.Contains(granted, scope)
+}
@@ -7,6 +7,13 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	watchWaitTime   = 30 * time.Second
+	minWatchBackoff = 500 * time.Millisecond
+	maxWatchBackoff = 30 * time.Second
 )
 
 type Registry struct {
@@ -63,14 +70,122 @@ func (r Registry) Discover(_ context.Context, serverName string) ([]string, erro
 		return nil, err
 	}
 
-	var instances []string
-	for _, entry := range entries {
-		instances = append(instances, entry.Service.Address+":"+strconv.Itoa(entry.Service.Port))
-	}
+	return instances(entries), nil
+}
+
+// Watch streams the healthy instances of serverName every time they change,
+// using Consul blocking queries. The channel is closed once ctx is done.
+func (r Registry) Watch(ctx context.Context, serverName string) (<-chan []string, error) {
+	updates := make(chan []string)
+
+	go func() {
+		defer close(updates)
+
+		var index uint64
+		backoff := minWatchBackoff
+		for {
+			opts := (&consul.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime}).WithContext(ctx)
+			entries, meta, err := r.client.Health().Service(serverName, "", true, opts)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to watch service %s: %v", serverName, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, maxWatchBackoff)
+				continue
+			}
+			backoff = minWatchBackoff
+
+			if index != 0 && meta.LastIndex == index {
+				continue
+			}
+			// Consul may reset its index; start over rather than block forever.
+			if meta.LastIndex < index {
+				index = 0
+			} else {
+				index = max(meta.LastIndex, 1)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- instances(entries):
+			}
+		}
+	}()
+
+	return updates, nil
+}
 
-	return instances, nil
+func (r Registry) PutKey(ctx context.Context, key string, value []byte) error {
+	_, err := r.client.KV().Put(&consul.KVPair{Key: key, Value: value}, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (r Registry) WatchKey(ctx context.Context, key string) (<-chan []byte, error) {
+	updates := make(chan []byte)
+
+	go func() {
+		defer close(updates)
+
+		var index uint64
+		backoff := minWatchBackoff
+		for {
+			opts := (&consul.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime}).WithContext(ctx)
+			pair, meta, err := r.client.KV().Get(key, opts)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to watch key %s: %v", key, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, maxWatchBackoff)
+				continue
+			}
+			backoff = minWatchBackoff
+
+			if index != 0 && meta.LastIndex == index {
+				continue
+			}
+			if meta.LastIndex < index {
+				index = 0
+			} else {
+				index = max(meta.LastIndex, 1)
+			}
+
+			var value []byte
+			if pair != nil {
+				value = pair.Value
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- value:
+			}
+		}
+	}()
+
+	return updates, nil
 }
 
 func (r Registry) HealthCheck(instanceID string) error {
 	return r.client.Agent().UpdateTTL(instanceID, "online", "pass")
 }
+
+func instances(entries []*consul.ServiceEntry) []string {
+	var addrs []string
+	for _, entry := range entries {
+		addrs = append(addrs, entry.Service.Address+":"+strconv.Itoa(entry.Service.Port))
+	}
+
+	return addrs
+}
@@ -12,9 +12,20 @@ type Registry interface {
 	Register(instanceID, serverName, hostPort string) error
 	DeRegister(instanceID string) error
 	Discover(ctx context.Context, serverName string) ([]string, error)
+	Watch(ctx context.Context, serverName string) (<-chan []string, error)
 	HealthCheck(instanceID string) error
 }
 
+// KV is implemented by registries that can also share small values between
+// services. It is used to broadcast cache invalidations, so a value is only
+// meaningful in that it changed.
+type KV interface {
+	PutKey(ctx context.Context, key string, value []byte) error
+	// WatchKey streams the value of key every time it changes, starting with
+	// the current value. The channel is closed once ctx is done.
+	WatchKey(ctx context.Context, key string) (<-chan []byte, error)
+}
+
 func GenerateInstanceID(serverName string) string {
 	randomBytes := make([]byte, 8)
 	_, err := rand.Read(randomBytes)
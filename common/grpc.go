@@ -2,22 +2,27 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"github.com/HJyup/mtl-common/interceptor"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
-	"math/rand"
 )
 
-func ServiceConnection(ctx context.Context, serviceName string, registry Registry) (*grpc.ClientConn, error) {
-	addr, err := registry.Discover(ctx, serviceName)
-	if err != nil {
-		return nil, err
-	}
+const roundRobinServiceConfig = `{"loadBalancingConfig":[{"round_robin":{}}]}`
 
-	return grpc.NewClient(
-		addr[rand.Intn(len(addr))],
+// ServiceConnection returns a long-lived connection to every healthy instance of
+// serviceName, balanced round-robin and kept in sync with the registry. opts are
+// applied last, so they may override the plaintext transport credentials.
+func ServiceConnection(_ context.Context, serviceName string, registry Registry, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithResolvers(NewResolverBuilder(registry)),
+		grpc.WithDefaultServiceConfig(roundRobinServiceConfig),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
-		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
-	)
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithChainUnaryInterceptor(interceptor.UnaryClientMetrics(), interceptor.UnaryClientRequestID(), interceptor.UnaryClientAuth()),
+		grpc.WithChainStreamInterceptor(interceptor.StreamClientMetrics(), interceptor.StreamClientRequestID(), interceptor.StreamClientAuth()),
+	}, opts...)
+
+	return grpc.NewClient(fmt.Sprintf("%s:///%s", ResolverScheme, serviceName), opts...)
 }
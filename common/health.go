@@ -0,0 +1,135 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DefaultHealthInterval = 2 * time.Second
+	healthCheckTimeout    = time.Second
+)
+
+type DependencyCheck func(ctx context.Context) error
+
+// HealthMonitor periodically runs dependency checks, publishes the result over
+// the standard gRPC health protocol and feeds the registry TTL check only while
+// every dependency is healthy.
+type HealthMonitor struct {
+	server     *health.Server
+	registry   Registry
+	instanceID string
+	interval   time.Duration
+
+	mu       sync.RWMutex
+	checks   map[string]DependencyCheck
+	serving  bool
+	shutdown bool
+}
+
+func NewHealthMonitor(registry Registry, instanceID string) *HealthMonitor {
+	server := health.NewServer()
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	return &HealthMonitor{
+		server:     server,
+		registry:   registry,
+		instanceID: instanceID,
+		interval:   DefaultHealthInterval,
+		checks:     make(map[string]DependencyCheck),
+	}
+}
+
+func (m *HealthMonitor) Register(grpcServer *grpc.Server) {
+	healthpb.RegisterHealthServer(grpcServer, m.server)
+}
+
+func (m *HealthMonitor) AddCheck(name string, check DependencyCheck) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checks[name] = check
+}
+
+func (m *HealthMonitor) Serving() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.serving
+}
+
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown marks every service as NOT_SERVING so that health-checking clients
+// stop routing new requests here, and stops feeding the registry TTL.
+func (m *HealthMonitor) Shutdown() {
+	m.mu.Lock()
+	m.serving = false
+	m.shutdown = true
+	m.mu.Unlock()
+
+	m.server.Shutdown()
+}
+
+func (m *HealthMonitor) check(ctx context.Context) {
+	m.mu.RLock()
+	checks := make(map[string]DependencyCheck, len(m.checks))
+	for name, check := range m.checks {
+		checks[name] = check
+	}
+	m.mu.RUnlock()
+
+	serving := true
+	for name, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := check(checkCtx)
+		cancel()
+		if err != nil {
+			log.Printf("Health check %s failed: %v", name, err)
+			serving = false
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.shutdown {
+		m.mu.Unlock()
+		return
+	}
+	m.serving = serving
+	m.mu.Unlock()
+
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	m.server.SetServingStatus("", status)
+
+	if !serving {
+		return
+	}
+	if err := m.registry.HealthCheck(m.instanceID); err != nil {
+		log.Printf("Failed to update registry health for %s: %v", m.instanceID, err)
+	}
+}
@@ -0,0 +1,138 @@
+package interceptor
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authorizationMetadataKey = "authorization"
+	healthServicePrefix      = "/grpc.health.v1.Health/"
+)
+
+type AuthConfig struct {
+	// Users verifies user tokens forwarded as "authorization: Bearer <token>".
+	Users auth.Verifier
+	// Revocations rejects user tokens whose ID or session ID it lists, as the
+	// gateway does; nil rejects none.
+	Revocations auth.Revocations
+	// Services verifies service identity tokens; nil rejects them.
+	Services *auth.ServiceIdentity
+	// TrustedServices may act on behalf of any user when no user token is
+	// forwarded.
+	TrustedServices []string
+	// PublicMethods are full method names, e.g. "/api.UserService/AuthUser",
+	// that may be called without credentials. Health checks always may.
+	PublicMethods []string
+}
+
+// UnaryServerAuth verifies the caller's credentials and stores the resulting
+// auth.Principal in the context. Whether the principal may touch a given
+// resource is left to the service, see auth.AuthorizeUser.
+func UnaryServerAuth(config AuthConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticate(ctx, config, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func StreamServerAuth(config AuthConfig) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), config, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func authenticate(ctx context.Context, config AuthConfig, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	userToken := firstValue(md, authorizationMetadataKey)
+	serviceToken := firstValue(md, auth.ServiceTokenMetadataKey)
+
+	if userToken == "" && serviceToken == "" {
+		if strings.HasPrefix(method, healthServicePrefix) || slices.Contains(config.PublicMethods, method) {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+
+	principal := &auth.Principal{}
+
+	if serviceToken != "" {
+		if config.Services == nil {
+			return nil, status.Error(codes.Unauthenticated, "service tokens are not accepted")
+		}
+		service, err := config.Services.Verify(serviceToken)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid service token")
+		}
+		principal.Service = service
+		principal.Trusted = slices.Contains(config.TrustedServices, service)
+	}
+
+	if userToken != "" {
+		token, ok := strings.CutPrefix(userToken, "Bearer ")
+		if !ok || config.Users == nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid authorization metadata")
+		}
+		claims, err := utils.ParseToken(config.Users, token)
+		if err != nil || claims.UserID == "" {
+			return nil, status.Error(codes.Unauthenticated, "invalid user token")
+		}
+		if revoked(config.Revocations, claims.ID) || revoked(config.Revocations, claims.SessionID) {
+			return nil, status.Error(codes.Unauthenticated, "user token has been revoked")
+		}
+		principal.UserID = claims.UserID
+		principal.SessionID = claims.SessionID
+		principal.TokenID = claims.ID
+		principal.Roles = claims.Roles
+		principal.Scopes = claims.Scopes
+	}
+
+	return auth.NewContext(ctx, principal), nil
+}
+
+func revoked(revocations auth.Revocations, id string) bool {
+	return revocations != nil && id != "" && revocations.Revoked(id)
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// UnaryClientAuth forwards the user token stored by auth.NewTokenContext, so
+// that the callee authorizes the request as that user.
+func UnaryClientAuth() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingUserToken(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func StreamClientAuth() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingUserToken(ctx), desc, cc, method, opts...)
+	}
+}
+
+func outgoingUserToken(ctx context.Context) context.Context {
+	if token := auth.TokenFromContext(ctx); token != "" {
+		return metadata.AppendToOutgoingContext(ctx, authorizationMetadataKey, "Bearer "+token)
+	}
+	return ctx
+}
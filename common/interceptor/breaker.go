@@ -0,0 +1,165 @@
+package interceptor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_client_circuit_breaker_state",
+		Help: "Circuit breaker state per target: 0 closed, 1 half-open, 2 open.",
+	}, []string{"target"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_circuit_breaker_transitions_total",
+		Help: "Circuit breaker state transitions per target.",
+	}, []string{"target", "state"})
+)
+
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before letting a probe through.
+	OpenTimeout time.Duration
+}
+
+type breaker struct {
+	target string
+	config BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(target string, config BreakerConfig) *breaker {
+	breakerState.WithLabelValues(target).Set(float64(BreakerClosed))
+	return &breaker{target: target, config: config}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !isBreakerFailure(err) {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.openedAt = time.Now()
+		if b.state != BreakerOpen {
+			b.transition(BreakerOpen)
+		}
+	}
+}
+
+// transition must be called with b.mu held.
+func (b *breaker) transition(state BreakerState) {
+	b.state = state
+	breakerState.WithLabelValues(b.target).Set(float64(state))
+	breakerTransitions.WithLabelValues(b.target, state.String()).Inc()
+}
+
+// isBreakerFailure only counts errors that point at an unhealthy target, not
+// application errors returned by a healthy one.
+func isBreakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// UnaryClientCircuitBreaker keeps one breaker per connection target. While a
+// breaker is open, calls fail fast with codes.Unavailable.
+func UnaryClientCircuitBreaker(config BreakerConfig) grpc.UnaryClientInterceptor {
+	var mu sync.Mutex
+	breakers := make(map[string]*breaker)
+
+	get := func(target string) *breaker {
+		mu.Lock()
+		defer mu.Unlock()
+
+		b, ok := breakers[target]
+		if !ok {
+			b = newBreaker(target, config)
+			breakers[target] = b
+		}
+		return b
+	}
+
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if config.FailureThreshold <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		b := get(cc.Target())
+		if !b.allow() {
+			return status.Errorf(codes.Unavailable, "circuit breaker open for %s", cc.Target())
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.record(err)
+		return err
+	}
+}
@@ -0,0 +1,24 @@
+package interceptor
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+type ClientConfig struct {
+	Timeout        time.Duration
+	MethodTimeouts map[string]time.Duration
+	Retry          RetryConfig
+	Breaker        BreakerConfig
+}
+
+// UnaryClientInterceptors returns the default client chain. The breaker wraps
+// the retries so that an open breaker fails fast instead of being retried.
+func UnaryClientInterceptors(config ClientConfig) []grpc.UnaryClientInterceptor {
+	return []grpc.UnaryClientInterceptor{
+		UnaryClientDeadline(config.Timeout, config.MethodTimeouts),
+		UnaryClientCircuitBreaker(config.Breaker),
+		UnaryClientRetry(config.Retry),
+	}
+}
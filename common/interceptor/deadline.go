@@ -0,0 +1,32 @@
+package interceptor
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// UnaryClientDeadline applies a default deadline to calls that do not already
+// carry one. methodTimeouts is keyed by full method name, e.g.
+// "/api.UserService/AuthUser", and overrides the default timeout.
+func UnaryClientDeadline(timeout time.Duration, methodTimeouts map[string]time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		d := timeout
+		if override, ok := methodTimeouts[method]; ok {
+			d = override
+		}
+		if d <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
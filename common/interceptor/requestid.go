@@ -0,0 +1,69 @@
+package interceptor
+
+import (
+	"context"
+
+	"github.com/HJyup/mtl-common/logging"
+	"github.com/HJyup/mtl-common/requestid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func UnaryClientRequestID() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func StreamClientRequestID() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingRequestID(ctx), desc, cc, method, opts...)
+	}
+}
+
+func outgoingRequestID(ctx context.Context) context.Context {
+	if id := requestid.FromContext(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, requestid.MetadataKey, id)
+	}
+	return ctx
+}
+
+// UnaryServerRequestID reads the request ID from incoming metadata, generating
+// one if the caller did not send it, and attaches a logger carrying it to the
+// context for logging.FromContext.
+func UnaryServerRequestID(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(incomingRequestID(ctx, logger), req)
+	}
+}
+
+func StreamServerRequestID(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: incomingRequestID(ss.Context(), logger)})
+	}
+}
+
+func incomingRequestID(ctx context.Context, logger *zap.Logger) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestid.MetadataKey); len(values) > 0 && requestid.Valid(values[0]) {
+			id = values[0]
+		}
+	}
+	if id == "" {
+		id = requestid.New()
+	}
+
+	ctx = requestid.NewContext(ctx, id)
+	return logging.NewContext(ctx, logger.With(zap.String("request_id", id)))
+}
+
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
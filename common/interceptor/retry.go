@@ -0,0 +1,80 @@
+package interceptor
+
+import (
+	"context"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "grpc_client_retries_total",
+	Help: "Number of retried gRPC client calls by method.",
+}, []string{"method"})
+
+type RetryConfig struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// IsIdempotent reports whether method is safe to retry. By convention only
+// Get* and Delete* RPCs are.
+func IsIdempotent(method string) bool {
+	name := path.Base(method)
+	return strings.HasPrefix(name, "Get") || strings.HasPrefix(name, "Delete")
+}
+
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// UnaryClientRetry retries idempotent calls that fail with a transient status,
+// waiting an exponentially growing, fully jittered delay between attempts.
+func UnaryClientRetry(config RetryConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if !IsIdempotent(method) {
+			return err
+		}
+
+		for attempt := 0; attempt < config.MaxRetries && isRetryable(err); attempt++ {
+			timer := time.NewTimer(backoff(config, attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+
+			retriesTotal.WithLabelValues(method).Inc()
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		return err
+	}
+}
+
+func backoff(config RetryConfig, attempt int) time.Duration {
+	d := config.BaseDelay << attempt
+	if d <= 0 || d > config.MaxDelay {
+		d = config.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return rand.N(d)
+}
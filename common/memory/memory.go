@@ -0,0 +1,210 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL                     = 5 * time.Second
+	DefaultDeregisterCriticalAfter = 10 * time.Second
+
+	expiryInterval = time.Second
+)
+
+var ErrInstanceNotFound = errors.New("instance not found")
+
+type instance struct {
+	serverName   string
+	hostPort     string
+	registeredAt time.Time
+	lastPass     time.Time
+}
+
+// Registry is an in-process registry mirroring the Consul TTL check: an
+// instance is healthy only while HealthCheck keeps being called within the TTL,
+// and is dropped once it has been critical for DeregisterCriticalAfter.
+type Registry struct {
+	ttl                     time.Duration
+	deregisterCriticalAfter time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*instance
+	values    map[string][]byte
+	changed   chan struct{}
+}
+
+func NewRegistry(ttl, deregisterCriticalAfter time.Duration) *Registry {
+	return &Registry{
+		ttl:                     ttl,
+		deregisterCriticalAfter: deregisterCriticalAfter,
+		instances:               make(map[string]*instance),
+		values:                  make(map[string][]byte),
+		changed:                 make(chan struct{}),
+	}
+}
+
+func (r *Registry) Register(instanceID, serverName, hostPort string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.instances[instanceID] = &instance{serverName: serverName, hostPort: hostPort, registeredAt: time.Now()}
+	r.notify()
+	return nil
+}
+
+func (r *Registry) DeRegister(instanceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.instances[instanceID]; !ok {
+		return ErrInstanceNotFound
+	}
+	delete(r.instances, instanceID)
+	r.notify()
+	return nil
+}
+
+func (r *Registry) Discover(_ context.Context, serverName string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.healthy(serverName), nil
+}
+
+func (r *Registry) Watch(ctx context.Context, serverName string) (<-chan []string, error) {
+	updates := make(chan []string)
+
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+
+		var last []string
+		first := true
+		for {
+			r.mu.Lock()
+			addrs := r.healthy(serverName)
+			changed := r.changed
+			r.mu.Unlock()
+
+			if first || !slices.Equal(last, addrs) {
+				select {
+				case <-ctx.Done():
+					return
+				case updates <- addrs:
+				}
+				last, first = addrs, false
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+func (r *Registry) PutKey(_ context.Context, key string, value []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[key] = slices.Clone(value)
+	r.notify()
+	return nil
+}
+
+func (r *Registry) WatchKey(ctx context.Context, key string) (<-chan []byte, error) {
+	updates := make(chan []byte)
+
+	go func() {
+		defer close(updates)
+
+		var last []byte
+		first := true
+		for {
+			r.mu.Lock()
+			value := r.values[key]
+			changed := r.changed
+			r.mu.Unlock()
+
+			if first || !bytes.Equal(last, value) {
+				select {
+				case <-ctx.Done():
+					return
+				case updates <- value:
+				}
+				last, first = value, false
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+func (r *Registry) HealthCheck(instanceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	inst, ok := r.instances[instanceID]
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	passing := r.passing(inst)
+	inst.lastPass = time.Now()
+	if !passing {
+		r.notify()
+	}
+	return nil
+}
+
+func (r *Registry) passing(inst *instance) bool {
+	return !inst.lastPass.IsZero() && time.Since(inst.lastPass) <= r.ttl
+}
+
+func (r *Registry) criticalSince(inst *instance) time.Time {
+	if inst.lastPass.IsZero() {
+		return inst.registeredAt
+	}
+	return inst.lastPass.Add(r.ttl)
+}
+
+// healthy must be called with r.mu held. It also reaps instances that have
+// been critical for longer than deregisterCriticalAfter.
+func (r *Registry) healthy(serverName string) []string {
+	var addrs []string
+	for id, inst := range r.instances {
+		if !r.passing(inst) && time.Since(r.criticalSince(inst)) > r.deregisterCriticalAfter {
+			delete(r.instances, id)
+			continue
+		}
+		if inst.serverName == serverName && r.passing(inst) {
+			addrs = append(addrs, inst.hostPort)
+		}
+	}
+	slices.Sort(addrs)
+
+	return addrs
+}
+
+// notify must be called with r.mu held.
+func (r *Registry) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"fmt"
+
+	common "github.com/HJyup/mtl-common"
+	"github.com/HJyup/mtl-common/consul"
+	"github.com/HJyup/mtl-common/memory"
+	"github.com/HJyup/mtl-common/static"
+)
+
+const (
+	KindConsul = "consul"
+	KindMemory = "memory"
+	KindStatic = "static"
+)
+
+// New builds the registry selected by kind. consulAddr is only used by the
+// Consul registry and file only by the static one.
+func New(kind, consulAddr, file string) (common.Registry, error) {
+	switch kind {
+	case "", KindConsul:
+		r, err := consul.NewRegistry(consulAddr)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case KindMemory:
+		return memory.NewRegistry(memory.DefaultTTL, memory.DefaultDeregisterCriticalAfter), nil
+	case KindStatic:
+		return static.NewRegistry(file)
+	default:
+		return nil, fmt.Errorf("unknown registry kind %q", kind)
+	}
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+)
+
+const ResolverScheme = "consul"
+
+var ErrNoInstances = errors.New("no healthy instances found")
+
+type ResolverBuilder struct {
+	registry Registry
+}
+
+func NewResolverBuilder(registry Registry) *ResolverBuilder {
+	return &ResolverBuilder{registry: registry}
+}
+
+func (b *ResolverBuilder) Scheme() string {
+	return ResolverScheme
+}
+
+func (b *ResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	serviceName := strings.TrimPrefix(target.Endpoint(), "/")
+	if serviceName == "" {
+		return nil, errors.New("missing service name in target")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := b.registry.Watch(ctx, serviceName)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &registryResolver{
+		cc:     cc,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go r.watch(updates)
+
+	return r, nil
+}
+
+type registryResolver struct {
+	cc resolver.ClientConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ResolveNow is a no-op: the registry watch already pushes every change.
+func (r *registryResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *registryResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *registryResolver) watch(updates <-chan []string) {
+	defer close(r.done)
+
+	var current []string
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case addrs, ok := <-updates:
+			if !ok {
+				return
+			}
+			if len(addrs) == 0 {
+				// Clear the old addresses so the ClientConn stops dialing
+				// instances the registry no longer lists. The balancer
+				// rejects an empty state, which is expected here.
+				if current != nil {
+					_ = r.cc.UpdateState(resolver.State{})
+				}
+				current = nil
+				r.cc.ReportError(ErrNoInstances)
+				continue
+			}
+			current = r.update(current, addrs)
+		}
+	}
+}
+
+func (r *registryResolver) update(current, addrs []string) []string {
+	addrs = slices.Clone(addrs)
+	slices.Sort(addrs)
+	if slices.Equal(current, addrs) {
+		return current
+	}
+
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if err := r.cc.UpdateState(state); err != nil {
+		return nil
+	}
+
+	return addrs
+}
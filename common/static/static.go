@@ -0,0 +1,142 @@
+package static
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const reloadInterval = 5 * time.Second
+
+// File is the on-disk layout, e.g.
+//
+//	services:
+//	  user: ["localhost:50051"]
+//	  configuration: ["localhost:50052"]
+type File struct {
+	Services map[string][]string `json:"services" yaml:"services"`
+}
+
+// Registry serves instances from a YAML or JSON file. Registration and health
+// checks are no-ops; the file is re-read whenever it changes on disk.
+type Registry struct {
+	path string
+
+	mu       sync.RWMutex
+	services map[string][]string
+	modTime  time.Time
+}
+
+func NewRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Registry) Register(_, _, _ string) error {
+	return nil
+}
+
+func (r *Registry) DeRegister(_ string) error {
+	return nil
+}
+
+func (r *Registry) Discover(_ context.Context, serverName string) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return slices.Clone(r.services[serverName]), nil
+}
+
+func (r *Registry) Watch(ctx context.Context, serverName string) (<-chan []string, error) {
+	updates := make(chan []string)
+
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+
+		var last []string
+		first := true
+		for {
+			addrs, _ := r.Discover(ctx, serverName)
+			if first || !slices.Equal(last, addrs) {
+				select {
+				case <-ctx.Done():
+					return
+				case updates <- addrs:
+				}
+				last, first = addrs, false
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.reload(); err != nil {
+					log.Printf("Failed to reload registry file %s: %v", r.path, err)
+				}
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+func (r *Registry) HealthCheck(_ string) error {
+	return nil
+}
+
+func (r *Registry) reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	unchanged := info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var file File
+	if filepath.Ext(r.path) == ".json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", r.path, err)
+	}
+
+	for name, addrs := range file.Services {
+		addrs = slices.Clone(addrs)
+		slices.Sort(addrs)
+		file.Services[name] = addrs
+	}
+
+	r.mu.Lock()
+	r.services = file.Services
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+
+	return nil
+}
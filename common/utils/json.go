@@ -3,6 +3,8 @@ package utils
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/HJyup/mtl-common/requestid"
 )
 
 func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -16,5 +18,9 @@ func ReadJSON(r *http.Request, data interface{}) error {
 }
 
 func WriteError(w http.ResponseWriter, status int, message string) {
-	WriteJSON(w, status, map[string]string{"error": message})
+	body := map[string]string{"error": message}
+	if id := w.Header().Get(requestid.Header); id != "" {
+		body["request_id"] = id
+	}
+	WriteJSON(w, status, body)
 }
@@ -2,51 +2,79 @@ package utils
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/HJyup/mtl-common/auth"
 	"github.com/golang-jwt/jwt/v4"
 )
 
-var jwtSecret = []byte("your-secret-key")
-
 type CustomClaims struct {
 	UserID   string `json:"user_id"`
 	Email    string `json:"email"`
 	UserName string `json:"user_name"`
+	// SessionID ties the token to a user session so that revoking the session
+	// revokes every access token issued for it.
+	SessionID string `json:"sid,omitempty"`
+	// Roles are snapshotted at sign in and refresh, so revoking a role takes
+	// effect within one access token lifetime.
+	Roles []string `json:"roles,omitempty"`
+	// Scopes are set on tokens exchanged for a personal access token, whose
+	// ID is then the SessionID. Tokens without scopes are unrestricted.
+	Scopes []string `json:"scopes,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func CreateToken(userID, email, userName string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &CustomClaims{
-		UserID:   userID,
-		Email:    email,
-		UserName: userName,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "translatify",
-		},
+func CreateToken(keys *auth.Keyring, userID, email, userName, sessionID string, roles []string, ttl time.Duration) (string, error) {
+	return signToken(keys, &CustomClaims{
+		UserID:    userID,
+		Email:     email,
+		UserName:  userName,
+		SessionID: sessionID,
+		Roles:     roles,
+	}, ttl)
+}
+
+// CreateScopedToken issues the access token a personal access token is
+// exchanged for. It never carries roles, so a leaked script token cannot be
+// used for administration.
+func CreateScopedToken(keys *auth.Keyring, userID, email, userName, personalTokenID string, scopes []string, ttl time.Duration) (string, error) {
+	return signToken(keys, &CustomClaims{
+		UserID:    userID,
+		Email:     email,
+		UserName:  userName,
+		SessionID: personalTokenID,
+		Scopes:    scopes,
+	}, ttl)
+}
+
+func signToken(keys *auth.Keyring, claims *CustomClaims, ttl time.Duration) (string, error) {
+	tokenID := make([]byte, 16)
+	if _, err := rand.Read(tokenID); err != nil {
+		return "", err
+	}
+
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "translatify",
+		ID:        hex.EncodeToString(tokenID),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-func ParseToken(tokenString string) (*CustomClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+func ParseToken(verifier auth.Verifier, tokenString string) (*CustomClaims, error) {
+	token, err := verifier.Parse(tokenString, &CustomClaims{})
 	if err != nil {
 		return nil, err
 	}
@@ -57,28 +85,63 @@ func ParseToken(tokenString string) (*CustomClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
-func TokenAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
-			return
-		}
-
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid Authorization header format. Expected 'Bearer <token>'", http.StatusUnauthorized)
-			return
-		}
-
-		tokenString := parts[1]
-		claims, err := ParseToken(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), "userID", claims.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// BearerToken returns the token from an "Authorization: Bearer <token>" header.
+func BearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("Missing Authorization header")
+	}
+
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errors.New("Invalid Authorization header format. Expected 'Bearer <token>'")
+	}
+	return parts[1], nil
+}
+
+// TokenAuthMiddleware accepts JWTs and, when pats is set, personal access
+// tokens, which are swapped for a JWT carrying their scopes.
+func TokenAuthMiddleware(verifier auth.Verifier, revocations auth.Revocations, pats *auth.PersonalAccessTokens) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, err := BearerToken(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			if auth.IsPersonalAccessToken(tokenString) {
+				if pats == nil {
+					http.Error(w, "Invalid token: personal access tokens are not accepted", http.StatusUnauthorized)
+					return
+				}
+				if tokenString, err = pats.AccessToken(r.Context(), tokenString); err != nil {
+					http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+
+			claims, err := ParseToken(verifier, tokenString)
+			if err != nil {
+				http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if revoked(revocations, claims.ID) || revoked(revocations, claims.SessionID) {
+				http.Error(w, "Invalid token: token has been revoked", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "userID", claims.UserID)
+			ctx = context.WithValue(ctx, "tokenID", claims.ID)
+			ctx = context.WithValue(ctx, "sessionID", claims.SessionID)
+			ctx = context.WithValue(ctx, "roles", claims.Roles)
+			ctx = context.WithValue(ctx, "scopes", claims.Scopes)
+			ctx = auth.NewTokenContext(ctx, tokenString)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func revoked(revocations auth.Revocations, id string) bool {
+	return id != "" && revocations.Revoked(id)
 }
@@ -5,107 +5,183 @@ import (
 	"github.com/HJyup/mlt-configuration/internal/handler"
 	"github.com/HJyup/mlt-configuration/internal/service"
 	"github.com/HJyup/mlt-configuration/internal/store"
-	common "github.com/HJyup/mtl-common"
-	"github.com/HJyup/mtl-common/consul"
+	"github.com/HJyup/mtl-common"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/app"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/interceptor"
+	"github.com/HJyup/mtl-common/mtls"
+	"github.com/HJyup/mtl-common/tracing"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/kelseyhightower/envconfig"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"net"
+	"log"
+	"time"
 )
 
 type Specification struct {
-	ServiceName   string `required:"true" default:"configuration"`
-	Address       string `required:"true"`
-	Consul        string `required:"true"`
-	Environment   string `required:"true"`
-	DBLink        string `required:"true"`
-	EncryptionKey string `required:"true"`
+	ServiceName      string `required:"true" default:"configuration"`
+	Address          string `required:"true"`
+	Registry         string `default:"consul"`
+	RegistryFile     string `envconfig:"registry_file"`
+	Consul           string
+	Environment      string        `required:"true"`
+	DeregisterDelay  time.Duration `envconfig:"deregister_delay" default:"2s"`
+	DrainTimeout     time.Duration `envconfig:"drain_timeout" default:"15s"`
+	TLSCertFile      string        `envconfig:"tls_cert_file"`
+	TLSKeyFile       string        `envconfig:"tls_key_file"`
+	TLSCAFile        string        `envconfig:"tls_ca_file"`
+	TraceExporter    string        `envconfig:"trace_exporter" default:"none"`
+	TraceEndpoint    string        `envconfig:"trace_endpoint"`
+	TraceInsecure    bool          `envconfig:"trace_insecure"`
+	TraceFile        string        `envconfig:"trace_file"`
+	TraceSampleRatio float64       `envconfig:"trace_sample_ratio" default:"1"`
+	MetricsAddress   string        `envconfig:"metrics_address"`
+	DBLink           string        `required:"true"`
+	EncryptionKey    string        `required:"true"`
+
+	// User tokens are verified against the user service's JWKS and, for
+	// HS256 deployments, a shared JWT keyring.
+	UserServiceName     string        `envconfig:"user_service_name" default:"user"`
+	JWKSRefreshInterval time.Duration `envconfig:"jwks_refresh_interval" default:"5m"`
+	JWTKeysFile         string        `envconfig:"jwt_keys_file"`
+	JWTSecret           string        `envconfig:"jwt_secret"`
+	JWTKeyID            string        `envconfig:"jwt_key_id"`
+
+	ServiceKeysFile string   `envconfig:"service_keys_file"`
+	ServiceSecret   string   `envconfig:"service_secret"`
+	TrustedServices []string `envconfig:"trusted_services" default:"agent"`
+	SecretReaders   []string `envconfig:"secret_readers" default:"agent"`
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	logger, err := zap.NewProduction()
-	if err != nil {
-		panic("Failed to create logger: " + err.Error())
+	var s Specification
+	if err := envconfig.Process("configuration", &s); err != nil {
+		log.Fatalf("Failed to process environment variables: %v", err)
 	}
-	defer func() {
-		_ = logger.Sync()
-	}()
 
-	var s Specification
-	if err = envconfig.Process("configuration", &s); err != nil {
-		logger.Fatal("Failed to process environment variables", zap.Error(err))
+	a, err := app.New(app.Options{
+		ServiceName:     s.ServiceName,
+		Address:         s.Address,
+		Registry:        s.Registry,
+		RegistryFile:    s.RegistryFile,
+		Consul:          s.Consul,
+		DeregisterDelay: s.DeregisterDelay,
+		DrainTimeout:    s.DrainTimeout,
+		MetricsAddress:  s.MetricsAddress,
+		TLS: mtls.Config{
+			CertFile: s.TLSCertFile,
+			KeyFile:  s.TLSKeyFile,
+			CAFile:   s.TLSCAFile,
+		},
+		Tracing: tracing.Config{
+			Environment: s.Environment,
+			Exporter:    s.TraceExporter,
+			Endpoint:    s.TraceEndpoint,
+			Insecure:    s.TraceInsecure,
+			File:        s.TraceFile,
+			SampleRatio: s.TraceSampleRatio,
+		},
+		ServiceKeys: auth.KeyringConfig{
+			KeysFile: s.ServiceKeysFile,
+			Secret:   s.ServiceSecret,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to create app: %v", err)
 	}
+	logger := a.Logger()
 
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
 
 	opts := options.Client().ApplyURI(s.DBLink).SetServerAPIOptions(serverAPI)
 
-	client, err := mongo.Connect(ctx, opts)
+	client, err := mongo.Connect(a.Context(), opts)
 	if err != nil {
 		logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
 	}
-	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
-			logger.Fatal("Failed to disconnect from MongoDB", zap.Error(err))
-		}
-	}()
+	a.OnStop("mongo", client.Disconnect)
 
-	if err = client.Database("admin").RunCommand(ctx, bson.D{{"ping", 1}}).Err(); err != nil {
-		logger.Panic("Failed to ping MongoDB", zap.Error(err))
+	if err = client.Ping(a.Context(), readpref.Primary()); err != nil {
+		logger.Fatal("Failed to ping MongoDB", zap.Error(err))
 	}
 
-	registry, err := consul.NewRegistry(s.Consul)
+	userConn, err := common.ServiceConnection(a.Context(), s.UserServiceName, a.Registry(),
+		grpc.WithTransportCredentials(a.ClientCredentials(s.UserServiceName)))
 	if err != nil {
-		logger.Fatal("Failed to create registry: %v", zap.Error(err))
+		logger.Fatal("Failed to connect to user service", zap.Error(err))
 	}
+	a.OnStop("user connection", func(context.Context) error {
+		return userConn.Close()
+	})
+
+	userClient := pb.NewUserServiceClient(userConn)
 
-	instanceID := common.GenerateInstanceID(s.ServiceName)
-	if err = registry.Register(instanceID, s.ServiceName, s.Address); err != nil {
-		logger.Fatal("Failed to register service: %v", zap.Error(err))
+	jwks := auth.NewJWKSCache(auth.UserServiceJWKS(userClient), s.JWKSRefreshInterval)
+	a.Go("jwks", func() error {
+		jwks.Run(a.Context())
+		return nil
+	})
+	verifier := auth.Verifier(jwks)
+	if s.JWTKeysFile != "" || s.JWTSecret != "" {
+		keys, err := auth.NewKeyring(auth.KeyringConfig{
+			KeysFile: s.JWTKeysFile,
+			Secret:   s.JWTSecret,
+			KeyID:    s.JWTKeyID,
+		})
+		if err != nil {
+			logger.Fatal("Failed to load JWT keys", zap.Error(err))
+		}
+		a.Go("jwt keys", func() error {
+			keys.Run(a.Context())
+			return nil
+		})
+		verifier = auth.Verifiers{jwks, keys}
 	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				if err = registry.HealthCheck(instanceID); err != nil {
-					logger.Error("Failed to health check: %v", zap.Error(err))
-				}
-			}
+
+	// Forwarded tokens that were signed out or whose session was revoked are
+	// refused here as they are at the gateway.
+	denylist := auth.NewDenylist(auth.UserServiceRevocations(userClient))
+	var revocationChanges <-chan []byte
+	if kv, ok := a.Registry().(common.KV); ok {
+		if revocationChanges, err = kv.WatchKey(a.Context(), auth.RevocationsKey); err != nil {
+			logger.Fatal("Failed to watch token revocations", zap.Error(err))
 		}
-	}()
-	defer registry.DeRegister(instanceID)
+	}
+	a.Go("denylist", func() error {
+		denylist.Run(a.Context(), revocationChanges)
+		return nil
+	})
 
-	grpcServer := grpc.NewServer()
-	conn, err := net.Listen("tcp", s.Address)
-	if err != nil {
-		logger.Fatal("Failed to listen on %s: %v", zap.String("port", s.Address), zap.Error(err))
+	authConfig := interceptor.AuthConfig{
+		Users:           verifier,
+		Revocations:     denylist,
+		Services:        a.ServiceIdentity(),
+		TrustedServices: s.TrustedServices,
 	}
-	defer func(conn net.Listener) {
-		err = conn.Close()
-		if err != nil {
-			logger.Warn("Failed to close connection", zap.Error(err))
-		}
-	}(conn)
+	grpcServer := grpc.NewServer(append(a.ServerOptions(),
+		grpc.ChainUnaryInterceptor(interceptor.UnaryServerAuth(authConfig)),
+		grpc.ChainStreamInterceptor(interceptor.StreamServerAuth(authConfig)))...)
+
+	a.Health().AddCheck("mongo", func(ctx context.Context) error {
+		return client.Ping(ctx, readpref.Primary())
+	})
+	a.Health().Register(grpcServer)
 
 	str := store.NewStore(client)
-	srv, err := service.NewService(str, logger, s.EncryptionKey)
+	srv, err := service.NewService(str, logger, s.EncryptionKey, s.SecretReaders)
 	if err != nil {
 		logger.Fatal("Failed to create service", zap.Error(err))
 	}
 	handler.NewHandler(grpcServer, srv)
 
-	logger.Info("Starting HTTP server", zap.String("port", s.Address))
+	a.ServeGRPC(grpcServer)
 
-	if err = grpcServer.Serve(conn); err != nil {
-		logger.Fatal("Failed to serve gRPC: %v", zap.Error(err))
+	if err = a.Run(); err != nil {
+		logger.Fatal("Service stopped with error", zap.Error(err))
 	}
 }
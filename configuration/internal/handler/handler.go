@@ -2,7 +2,10 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"github.com/HJyup/mlt-configuration/internal/service"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -13,6 +16,7 @@ type Service interface {
 	UpdateConfiguration(ctx context.Context, p *pb.UpdateConfigurationRequest) (*pb.UpdateConfigurationResponse, error)
 	GetConfiguration(ctx context.Context, p *pb.GetConfigurationRequest) (*pb.GetConfigurationResponse, error)
 	DeleteConfiguration(ctx context.Context, p *pb.DeleteConfigurationRequest) (*pb.DeleteConfigurationResponse, error)
+	GetConfigurationMetadata(ctx context.Context, p *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error)
 }
 
 type Handler struct {
@@ -31,6 +35,9 @@ func NewHandler(grpcServer *grpc.Server, service Service) *Handler {
 func (h *Handler) CreateConfiguration(ctx context.Context, req *pb.CreateConfigurationRequest) (*pb.CreateConfigurationResponse, error) {
 	resp, err := h.service.CreateConfiguration(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
 		return nil, status.Errorf(codes.Internal, "failed to create configuration: %v", err)
 	}
 	return resp, nil
@@ -39,6 +46,9 @@ func (h *Handler) CreateConfiguration(ctx context.Context, req *pb.CreateConfigu
 func (h *Handler) UpdateConfiguration(ctx context.Context, req *pb.UpdateConfigurationRequest) (*pb.UpdateConfigurationResponse, error) {
 	resp, err := h.service.UpdateConfiguration(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
 		return nil, status.Errorf(codes.Internal, "failed to update configuration: %v", err)
 	}
 	return resp, nil
@@ -47,6 +57,9 @@ func (h *Handler) UpdateConfiguration(ctx context.Context, req *pb.UpdateConfigu
 func (h *Handler) GetConfigurationByUserID(ctx context.Context, req *pb.GetConfigurationRequest) (*pb.GetConfigurationResponse, error) {
 	resp, err := h.service.GetConfiguration(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
 		return nil, status.Errorf(codes.Internal, "failed to get configuration: %v", err)
 	}
 	return resp, nil
@@ -55,7 +68,37 @@ func (h *Handler) GetConfigurationByUserID(ctx context.Context, req *pb.GetConfi
 func (h *Handler) DeleteConfigurationByUserID(ctx context.Context, req *pb.DeleteConfigurationRequest) (*pb.DeleteConfigurationResponse, error) {
 	resp, err := h.service.DeleteConfiguration(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
 		return nil, status.Errorf(codes.Internal, "failed to delete configuration: %v", err)
 	}
 	return resp, nil
 }
+
+func (h *Handler) GetConfigurationMetadata(ctx context.Context, req *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error) {
+	resp, err := h.service.GetConfigurationMetadata(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrorNotFound) {
+			return nil, status.Error(codes.NotFound, "configuration not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get configuration metadata: %v", err)
+	}
+	return resp, nil
+}
+
+// authStatus maps the service's authorization errors to gRPC statuses, or
+// returns nil for any other error.
+func authStatus(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	case errors.Is(err, auth.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, "permission denied")
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,16 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	operationEncrypt = "encrypt"
+	operationDecrypt = "decrypt"
+)
+
+var cryptoFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "configuration_crypto_failures_total",
+	Help: "Number of failed secret encryptions and decryptions, by operation and field.",
+}, []string{"operation", "field"})
@@ -5,8 +5,11 @@ import (
 	"encoding/base64"
 	"errors"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/logging"
 	"github.com/HJyup/mtl-common/utils"
 	"go.uber.org/zap"
+	"slices"
 )
 
 var (
@@ -26,9 +29,12 @@ type Service struct {
 	store  Store
 	logger *zap.Logger
 	encKey []byte
+	// secretReaders are the services that receive decrypted API keys; every
+	// other caller gets them masked.
+	secretReaders []string
 }
 
-func NewService(store Store, logger *zap.Logger, encKeyStr string) (*Service, error) {
+func NewService(store Store, logger *zap.Logger, encKeyStr string, secretReaders []string) (*Service, error) {
 	encKey, err := base64.StdEncoding.DecodeString(encKeyStr)
 	if err != nil {
 		return nil, err
@@ -39,20 +45,30 @@ func NewService(store Store, logger *zap.Logger, encKeyStr string) (*Service, er
 	}
 
 	return &Service{
-		store:  store,
-		logger: logger,
-		encKey: encKey,
+		store:         store,
+		logger:        logger,
+		encKey:        encKey,
+		secretReaders: secretReaders,
 	}, nil
 }
 
+// log returns the request-scoped logger set by the server interceptors, which
+// carries the caller's request ID.
+func (svc *Service) log(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, svc.logger)
+}
+
 func (svc *Service) CreateConfiguration(ctx context.Context, p *pb.CreateConfigurationRequest) (*pb.CreateConfigurationResponse, error) {
 	if p.UserId == "" {
 		return nil, ErrorEmptyUserID
 	}
+	if err := auth.AuthorizeUser(ctx, p.UserId); err != nil {
+		return nil, err
+	}
 
 	_, err := svc.store.CreateConfiguration(ctx, p.UserId)
 	if err != nil {
-		svc.logger.Error("failed to create configuration", zap.Error(err), zap.String("userID", p.UserId))
+		svc.log(ctx).Error("failed to create configuration", zap.Error(err), zap.String("userID", p.UserId))
 		return nil, err
 	}
 
@@ -65,10 +81,13 @@ func (svc *Service) GetConfiguration(ctx context.Context, p *pb.GetConfiguration
 	if p.UserId == "" {
 		return nil, ErrorEmptyUserID
 	}
+	if err := auth.AuthorizeUser(ctx, p.UserId); err != nil {
+		return nil, err
+	}
 
 	config, err := svc.store.GetConfiguration(ctx, p.UserId)
 	if err != nil {
-		svc.logger.Error("failed to get configuration", zap.Error(err), zap.String("userID", p.UserId))
+		svc.log(ctx).Error("failed to get configuration", zap.Error(err), zap.String("userID", p.UserId))
 		return nil, err
 	}
 
@@ -78,16 +97,23 @@ func (svc *Service) GetConfiguration(ctx context.Context, p *pb.GetConfiguration
 
 	openAIKey, err := utils.Decrypt(config.OpenAIKey, svc.encKey)
 	if err != nil {
-		svc.logger.Error("failed to decrypt OpenAI key", zap.Error(err))
+		svc.log(ctx).Error("failed to decrypt OpenAI key", zap.Error(err))
+		cryptoFailures.WithLabelValues(operationDecrypt, "openai_key").Inc()
 		return nil, errors.New("failed to decrypt API key")
 	}
 
 	googleAPIKey, err := utils.Decrypt(config.Calendar.GoogleAPIKey, svc.encKey)
 	if err != nil {
-		svc.logger.Error("failed to decrypt Google API key", zap.Error(err))
+		svc.log(ctx).Error("failed to decrypt Google API key", zap.Error(err))
+		cryptoFailures.WithLabelValues(operationDecrypt, "google_api_key").Inc()
 		googleAPIKey = ""
 	}
 
+	if !svc.canReadSecrets(ctx) {
+		openAIKey = maskSecret(openAIKey)
+		googleAPIKey = maskSecret(googleAPIKey)
+	}
+
 	return &pb.GetConfigurationResponse{
 		UserId:    config.UserID,
 		OpenAiKey: openAIKey,
@@ -101,14 +127,63 @@ func (svc *Service) GetConfiguration(ctx context.Context, p *pb.GetConfiguration
 	}, nil
 }
 
+// GetConfigurationMetadata lets admins see which settings a user has filled in
+// without exposing any of them.
+func (svc *Service) GetConfigurationMetadata(ctx context.Context, p *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error) {
+	if p.UserId == "" {
+		return nil, ErrorEmptyUserID
+	}
+	if err := auth.AuthorizeRole(ctx, auth.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	config, err := svc.store.GetConfiguration(ctx, p.UserId)
+	if err != nil {
+		svc.log(ctx).Error("failed to get configuration metadata", zap.Error(err), zap.String("userID", p.UserId))
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, ErrorNotFound
+	}
+
+	return &pb.GetConfigurationMetadataResponse{
+		UserId:             config.UserID,
+		HasOpenAiKey:       config.OpenAIKey != "",
+		HasGoogleApiKey:    config.Calendar.GoogleAPIKey != "",
+		HasCalendarContext: config.Calendar.Context != "",
+		HasThingsContext:   config.Things.Context != "",
+	}, nil
+}
+
+func (svc *Service) canReadSecrets(ctx context.Context) bool {
+	principal := auth.FromContext(ctx)
+	return principal != nil && principal.Service != "" && slices.Contains(svc.secretReaders, principal.Service)
+}
+
+// maskSecret keeps the last four characters of long enough secrets so users
+// can tell which key is stored.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 12 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
 func (svc *Service) UpdateConfiguration(ctx context.Context, p *pb.UpdateConfigurationRequest) (*pb.UpdateConfigurationResponse, error) {
 	if p.UserId == "" {
 		return nil, ErrorEmptyUserID
 	}
+	if err := auth.AuthorizeUser(ctx, p.UserId); err != nil {
+		return nil, err
+	}
 
 	existingConfig, err := svc.store.GetConfiguration(ctx, p.UserId)
 	if err != nil {
-		svc.logger.Error("failed to get configuration for update", zap.Error(err), zap.String("userID", p.UserId))
+		svc.log(ctx).Error("failed to get configuration for update", zap.Error(err), zap.String("userID", p.UserId))
 		return nil, err
 	}
 
@@ -120,7 +195,8 @@ func (svc *Service) UpdateConfiguration(ctx context.Context, p *pb.UpdateConfigu
 	if p.OpenAiKey != "" {
 		encryptedOpenAIKey, err = utils.Encrypt(p.OpenAiKey, svc.encKey)
 		if err != nil {
-			svc.logger.Error("failed to encrypt OpenAI key", zap.Error(err))
+			svc.log(ctx).Error("failed to encrypt OpenAI key", zap.Error(err))
+			cryptoFailures.WithLabelValues(operationEncrypt, "openai_key").Inc()
 			return nil, errors.New("failed to encrypt API key")
 		}
 	}
@@ -132,7 +208,8 @@ func (svc *Service) UpdateConfiguration(ctx context.Context, p *pb.UpdateConfigu
 		if p.Calendar.GoogleApiKey != "" {
 			encryptedGoogleAPIKey, err := utils.Encrypt(p.Calendar.GoogleApiKey, svc.encKey)
 			if err != nil {
-				svc.logger.Error("failed to encrypt Google API key", zap.Error(err))
+				svc.log(ctx).Error("failed to encrypt Google API key", zap.Error(err))
+				cryptoFailures.WithLabelValues(operationEncrypt, "google_api_key").Inc()
 				encryptedGoogleAPIKey = ""
 			}
 			calendarConfig.GoogleAPIKey = encryptedGoogleAPIKey
@@ -155,7 +232,7 @@ func (svc *Service) UpdateConfiguration(ctx context.Context, p *pb.UpdateConfigu
 
 	_, err = svc.store.UpdateConfiguration(ctx, updatedConfig)
 	if err != nil {
-		svc.logger.Error("failed to update configuration", zap.Error(err), zap.String("userID", p.UserId))
+		svc.log(ctx).Error("failed to update configuration", zap.Error(err), zap.String("userID", p.UserId))
 		return nil, err
 	}
 
@@ -169,10 +246,13 @@ func (svc *Service) DeleteConfiguration(ctx context.Context, p *pb.DeleteConfigu
 	if p.UserId == "" {
 		return nil, ErrorEmptyUserID
 	}
+	if err := auth.AuthorizeUser(ctx, p.UserId); err != nil {
+		return nil, err
+	}
 
 	err := svc.store.DeleteConfiguration(ctx, p.UserId)
 	if err != nil {
-		svc.logger.Error("failed to delete configuration", zap.Error(err), zap.String("userID", p.UserId))
+		svc.log(ctx).Error("failed to delete configuration", zap.Error(err), zap.String("userID", p.UserId))
 		return nil, err
 	}
 
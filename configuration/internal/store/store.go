@@ -54,7 +54,7 @@ func (s *Store) GetConfiguration(ctx context.Context, userID string) (*service.C
 	err := collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&config)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, errors.New("configuration not found")
+			return nil, service.ErrorNotFound
 		}
 		return nil, fmt.Errorf("failed to get configuration: %w", err)
 	}
@@ -72,7 +72,7 @@ func (s *Store) UpdateConfiguration(ctx context.Context, config *service.Configu
 	err := collection.FindOneAndReplace(ctx, filter, config, opts).Decode(&updatedConfig)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, errors.New("configuration not found")
+			return nil, service.ErrorNotFound
 		}
 		return nil, fmt.Errorf("failed to update configuration: %w", err)
 	}
@@ -89,7 +89,7 @@ func (s *Store) DeleteConfiguration(ctx context.Context, userID string) error {
 	}
 
 	if result.DeletedCount == 0 {
-		return errors.New("configuration not found")
+		return service.ErrorNotFound
 	}
 
 	return nil
@@ -4,82 +4,222 @@ import (
 	"context"
 	"github.com/HJyup/mlt-gateway/internal/gateway"
 	"github.com/HJyup/mlt-gateway/internal/handler"
+	"github.com/HJyup/mlt-gateway/internal/middleware"
+	"github.com/HJyup/mlt-gateway/internal/oidc"
 	"github.com/HJyup/mtl-common"
-	"github.com/HJyup/mtl-common/consul"
+	"github.com/HJyup/mtl-common/app"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/interceptor"
+	"github.com/HJyup/mtl-common/mtls"
+	"github.com/HJyup/mtl-common/tracing"
+	"github.com/HJyup/mtl-common/utils"
 	mux2 "github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
 
 type Specification struct {
-	ServiceName string `required:"true" default:"gateway"`
-	Address     string `required:"true"`
-	Consul      string `required:"true"`
-	Environment string `required:"true"`
+	ServiceName      string `required:"true" default:"gateway"`
+	Address          string `required:"true"`
+	Registry         string `default:"consul"`
+	RegistryFile     string `envconfig:"registry_file"`
+	Consul           string
+	Environment      string        `required:"true"`
+	DeregisterDelay  time.Duration `envconfig:"deregister_delay" default:"2s"`
+	DrainTimeout     time.Duration `envconfig:"drain_timeout" default:"15s"`
+	TLSCertFile      string        `envconfig:"tls_cert_file"`
+	TLSKeyFile       string        `envconfig:"tls_key_file"`
+	TLSCAFile        string        `envconfig:"tls_ca_file"`
+	TraceExporter    string        `envconfig:"trace_exporter" default:"none"`
+	TraceEndpoint    string        `envconfig:"trace_endpoint"`
+	TraceInsecure    bool          `envconfig:"trace_insecure"`
+	TraceFile        string        `envconfig:"trace_file"`
+	TraceSampleRatio float64       `envconfig:"trace_sample_ratio" default:"1"`
+	MetricsAddress   string        `envconfig:"metrics_address"`
+	JWTKeysFile      string        `envconfig:"jwt_keys_file"`
+	JWTSecret        string        `envconfig:"jwt_secret"`
+	JWTKeyID         string        `envconfig:"jwt_key_id"`
+
+	JWKSRefreshInterval time.Duration `envconfig:"jwks_refresh_interval" default:"5m"`
+
+	ServiceKeysFile string `envconfig:"service_keys_file"`
+	ServiceSecret   string `envconfig:"service_secret"`
+
+	// OIDCProvidersFile lists the OpenID Connect providers users may sign in
+	// with; sign in through providers is disabled when empty.
+	OIDCProvidersFile string `envconfig:"oidc_providers_file"`
+
+	ClientTimeout          time.Duration            `envconfig:"client_timeout" default:"5s"`
+	ClientMethodTimeouts   map[string]time.Duration `envconfig:"client_method_timeouts"`
+	ClientMaxRetries       int                      `envconfig:"client_max_retries" default:"3"`
+	ClientRetryBaseDelay   time.Duration            `envconfig:"client_retry_base_delay" default:"50ms"`
+	ClientRetryMaxDelay    time.Duration            `envconfig:"client_retry_max_delay" default:"1s"`
+	ClientBreakerThreshold int                      `envconfig:"client_breaker_threshold" default:"5"`
+	ClientBreakerTimeout   time.Duration            `envconfig:"client_breaker_timeout" default:"10s"`
 }
 
 func main() {
-	_, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var s Specification
+	if err := envconfig.Process("gateway", &s); err != nil {
+		log.Fatalf("Failed to process environment variables: %v", err)
+	}
 
-	logger, err := zap.NewProduction()
+	a, err := app.New(app.Options{
+		ServiceName:     s.ServiceName,
+		Address:         s.Address,
+		Registry:        s.Registry,
+		RegistryFile:    s.RegistryFile,
+		Consul:          s.Consul,
+		DeregisterDelay: s.DeregisterDelay,
+		DrainTimeout:    s.DrainTimeout,
+		MetricsAddress:  s.MetricsAddress,
+		TLS: mtls.Config{
+			CertFile: s.TLSCertFile,
+			KeyFile:  s.TLSKeyFile,
+			CAFile:   s.TLSCAFile,
+		},
+		Tracing: tracing.Config{
+			Environment: s.Environment,
+			Exporter:    s.TraceExporter,
+			Endpoint:    s.TraceEndpoint,
+			Insecure:    s.TraceInsecure,
+			File:        s.TraceFile,
+			SampleRatio: s.TraceSampleRatio,
+		},
+		ServiceKeys: auth.KeyringConfig{
+			KeysFile: s.ServiceKeysFile,
+			Secret:   s.ServiceSecret,
+		},
+	})
 	if err != nil {
-		panic("Failed to create logger: " + err.Error())
+		log.Fatalf("Failed to create app: %v", err)
 	}
-	defer func() {
-		_ = logger.Sync()
-	}()
+	logger := a.Logger()
 
-	var s Specification
-	if err = envconfig.Process("gateway", &s); err != nil {
-		logger.Fatal("Failed to process environment variables", zap.Error(err))
-	}
+	clientInterceptors := interceptor.UnaryClientInterceptors(interceptor.ClientConfig{
+		Timeout:        s.ClientTimeout,
+		MethodTimeouts: s.ClientMethodTimeouts,
+		Retry: interceptor.RetryConfig{
+			MaxRetries: s.ClientMaxRetries,
+			BaseDelay:  s.ClientRetryBaseDelay,
+			MaxDelay:   s.ClientRetryMaxDelay,
+		},
+		Breaker: interceptor.BreakerConfig{
+			FailureThreshold: s.ClientBreakerThreshold,
+			OpenTimeout:      s.ClientBreakerTimeout,
+		},
+	})
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		cancel()
-	}()
+	userConn := serviceConnection(a, gateway.UserServiceName, clientInterceptors)
+	configConn := serviceConnection(a, gateway.ConfigurationServiceName, clientInterceptors)
+	agentConn := serviceConnection(a, gateway.AgentServiceName, clientInterceptors)
 
-	registry, err := consul.NewRegistry(s.Consul)
-	if err != nil {
-		logger.Fatal("Failed to create registry", zap.Error(err))
-	}
+	userGateway := gateway.NewUserGateway(userConn, logger)
 
-	instanceID := common.GenerateInstanceID(s.ServiceName)
-	if err = registry.Register(instanceID, s.ServiceName, s.Address); err != nil {
-		logger.Fatal("Failed to register service", zap.Error(err))
-	}
-	defer func(registry *consul.Registry, instanceID string) {
-		err = registry.DeRegister(instanceID)
+	jwks := auth.NewJWKSCache(userGateway.JWKS, s.JWKSRefreshInterval)
+	a.Go("jwks", func() error {
+		jwks.Run(a.Context())
+		return nil
+	})
+	verifier := auth.Verifier(jwks)
+	if s.JWTKeysFile != "" || s.JWTSecret != "" {
+		keys, err := auth.NewKeyring(auth.KeyringConfig{
+			KeysFile: s.JWTKeysFile,
+			Secret:   s.JWTSecret,
+			KeyID:    s.JWTKeyID,
+		})
 		if err != nil {
-			logger.Fatal("Failed to deregister service: %v", zap.Error(err))
+			logger.Fatal("Failed to load JWT keys", zap.Error(err))
+		}
+		a.Go("jwt keys", func() error {
+			keys.Run(a.Context())
+			return nil
+		})
+		verifier = auth.Verifiers{jwks, keys}
+	}
+
+	denylist := auth.NewDenylist(userGateway.RevokedTokens)
+	var revocationChanges <-chan []byte
+	if kv, ok := a.Registry().(common.KV); ok {
+		if revocationChanges, err = kv.WatchKey(a.Context(), auth.RevocationsKey); err != nil {
+			logger.Fatal("Failed to watch token revocations", zap.Error(err))
 		}
-	}(registry, instanceID)
+	}
+	a.Go("denylist", func() error {
+		denylist.Run(a.Context(), revocationChanges)
+		return nil
+	})
+
+	pats := auth.NewPersonalAccessTokens(userGateway.ExchangePersonalAccessToken)
+	authenticate := utils.TokenAuthMiddleware(verifier, denylist, pats)
 
 	router := mux2.NewRouter()
+	router.Use(middleware.Tracing(s.ServiceName))
+	router.Use(middleware.Metrics())
 
-	userGateway := gateway.NewUserGateway(registry, logger)
-	userHandler := handler.NewUserHandler(userGateway)
+	jwksHandler := handler.NewJWKSHandler(jwks)
+	jwksHandler.RegisterRoutes(router)
+
+	userHandler := handler.NewUserHandler(userGateway, authenticate, denylist)
 	userHandler.RegisterRoutes(router)
 
-	configGateway := gateway.NewConfigurationGateway(registry, logger)
-	configHandler := handler.NewConfigurationHandler(configGateway)
+	if s.OIDCProvidersFile != "" {
+		configs, err := oidc.LoadProviders(s.OIDCProvidersFile)
+		if err != nil {
+			logger.Fatal("Failed to load OIDC providers", zap.Error(err))
+		}
+		providerClient := &http.Client{Timeout: 10 * time.Second}
+		providers := make([]*oidc.Provider, 0, len(configs))
+		for _, config := range configs {
+			providers = append(providers, oidc.NewProvider(config, providerClient))
+		}
+		oidcHandler := handler.NewOIDCHandler(providers, userGateway)
+		oidcHandler.RegisterRoutes(router)
+	}
+
+	configGateway := gateway.NewConfigurationGateway(configConn, logger)
+	configHandler := handler.NewConfigurationHandler(configGateway, authenticate)
 	configHandler.RegisterRoutes(router)
 
-	agentGateway := gateway.NewAgentGateway(registry, logger)
-	agentHandler := handler.NewAgentHandler(agentGateway)
+	adminHandler := handler.NewAdminHandler(userGateway, configGateway, authenticate)
+	adminHandler.RegisterRoutes(router)
+
+	agentGateway := gateway.NewAgentGateway(agentConn, logger)
+	agentHandler := handler.NewAgentHandler(agentGateway, authenticate, denylist)
 	agentHandler.RegisterRoutes(router)
 
-	logger.Info("Starting server", zap.String("address", s.Address))
-	if err = http.ListenAndServe(s.Address, router); err != nil {
-		logger.Fatal("Failed to start server", zap.Error(err))
+	// Wraps the router rather than router.Use so unmatched routes get an ID too.
+	server := &http.Server{Handler: middleware.RequestID(router)}
+	server.RegisterOnShutdown(agentHandler.Shutdown)
+	a.ServeHTTP(server)
+
+	if err = a.Run(); err != nil {
+		logger.Fatal("Service stopped with error", zap.Error(err))
 	}
 }
+
+func serviceConnection(a *app.App, serviceName string, interceptors []grpc.UnaryClientInterceptor) *grpc.ClientConn {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(a.ClientCredentials(serviceName)),
+		grpc.WithChainUnaryInterceptor(interceptors...),
+	}
+	if identity := a.ServiceIdentity(); identity != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(identity.Credentials(serviceName)))
+	}
+
+	conn, err := common.ServiceConnection(a.Context(), serviceName, a.Registry(), opts...)
+	if err != nil {
+		a.Logger().Fatal("Failed to connect to service", zap.String("service", serviceName), zap.Error(err))
+	}
+	a.OnStop(serviceName+" connection", func(context.Context) error {
+		return conn.Close()
+	})
+
+	return conn
+}
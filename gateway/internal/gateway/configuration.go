@@ -2,9 +2,9 @@ package gateway
 
 import (
 	"context"
-	common "github.com/HJyup/mtl-common"
 	pb "github.com/HJyup/mtl-common/api"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 type Configuration interface {
@@ -12,54 +12,38 @@ type Configuration interface {
 	UpdateConfiguration(context.Context, *pb.UpdateConfigurationRequest) (*pb.UpdateConfigurationResponse, error)
 	GetConfiguration(context.Context, *pb.GetConfigurationRequest) (*pb.GetConfigurationResponse, error)
 	DeleteConfiguration(context.Context, *pb.DeleteConfigurationRequest) (*pb.DeleteConfigurationResponse, error)
+	GetConfigurationMetadata(context.Context, *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error)
 }
 
 var (
-	ConfigurationServiceName          = "configuration"
-	FailedToConnectConfigurationError = "Failed to connect to configuration service"
+	ConfigurationServiceName = "configuration"
 )
 
 type ConfigurationGateway struct {
-	registry common.Registry
-	logger   *zap.Logger
+	client pb.ConfigurationServiceClient
+	logger *zap.Logger
 }
 
-func NewConfigurationGateway(registry common.Registry, logger *zap.Logger) *ConfigurationGateway {
-	return &ConfigurationGateway{registry: registry, logger: logger}
+func NewConfigurationGateway(conn *grpc.ClientConn, logger *zap.Logger) *ConfigurationGateway {
+	return &ConfigurationGateway{client: pb.NewConfigurationServiceClient(conn), logger: logger}
 }
 
 func (g *ConfigurationGateway) CreateConfiguration(ctx context.Context, payload *pb.CreateConfigurationRequest) (*pb.CreateConfigurationResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), ConfigurationServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectConfigurationError)
-	}
-	configClient := pb.NewConfigurationServiceClient(conn)
-	return configClient.CreateConfiguration(ctx, payload)
+	return g.client.CreateConfiguration(ctx, payload)
 }
 
 func (g *ConfigurationGateway) UpdateConfiguration(ctx context.Context, payload *pb.UpdateConfigurationRequest) (*pb.UpdateConfigurationResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), ConfigurationServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectConfigurationError)
-	}
-	configClient := pb.NewConfigurationServiceClient(conn)
-	return configClient.UpdateConfiguration(ctx, payload)
+	return g.client.UpdateConfiguration(ctx, payload)
 }
 
 func (g *ConfigurationGateway) GetConfiguration(ctx context.Context, payload *pb.GetConfigurationRequest) (*pb.GetConfigurationResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), ConfigurationServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectConfigurationError)
-	}
-	configClient := pb.NewConfigurationServiceClient(conn)
-	return configClient.GetConfigurationByUserID(ctx, payload)
+	return g.client.GetConfigurationByUserID(ctx, payload)
 }
 
 func (g *ConfigurationGateway) DeleteConfiguration(ctx context.Context, payload *pb.DeleteConfigurationRequest) (*pb.DeleteConfigurationResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), ConfigurationServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectConfigurationError)
-	}
-	configClient := pb.NewConfigurationServiceClient(conn)
-	return configClient.DeleteConfigurationByUserID(ctx, payload)
+	return g.client.DeleteConfigurationByUserID(ctx, payload)
+}
+
+func (g *ConfigurationGateway) GetConfigurationMetadata(ctx context.Context, payload *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error) {
+	return g.client.GetConfigurationMetadata(ctx, payload)
 }
@@ -2,57 +2,158 @@ package gateway
 
 import (
 	"context"
-	common "github.com/HJyup/mtl-common"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"time"
 )
 
 var (
-	UserServiceName          = "user"
-	FailedToConnectUserError = "Failed to connect to chat service"
+	UserServiceName = "user"
 )
 
 type UserGateway struct {
-	registry common.Registry
-	logger   *zap.Logger
+	client pb.UserServiceClient
+	logger *zap.Logger
 }
 
-func NewUserGateway(registry common.Registry, logger *zap.Logger) *UserGateway {
-	return &UserGateway{registry: registry, logger: logger}
+func NewUserGateway(conn *grpc.ClientConn, logger *zap.Logger) *UserGateway {
+	return &UserGateway{client: pb.NewUserServiceClient(conn), logger: logger}
 }
 
 func (g *UserGateway) CreatUser(ctx context.Context, payload *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), UserServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectUserError)
-	}
-	chatClient := pb.NewUserServiceClient(conn)
-	return chatClient.CreateUser(ctx, payload)
+	return g.client.CreateUser(ctx, payload)
 }
 
 func (g *UserGateway) AuthUser(ctx context.Context, payload *pb.AuthUserRequest) (*pb.AuthUserResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), UserServiceName, g.registry)
-	if err != nil {
-		g.logger.Error(FailedToConnectUserError)
-	}
-	chatClient := pb.NewUserServiceClient(conn)
-	return chatClient.AuthUser(ctx, payload)
+	return g.client.AuthUser(ctx, payload)
+}
+
+func (g *UserGateway) RefreshToken(ctx context.Context, payload *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	return g.client.RefreshToken(ctx, payload)
+}
+
+func (g *UserGateway) Logout(ctx context.Context, payload *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	return g.client.Logout(ctx, payload)
+}
+
+func (g *UserGateway) ListSessions(ctx context.Context, payload *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	return g.client.ListSessions(ctx, payload)
+}
+
+func (g *UserGateway) RevokeSession(ctx context.Context, payload *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	return g.client.RevokeSession(ctx, payload)
+}
+
+func (g *UserGateway) RevokeOtherSessions(ctx context.Context, payload *pb.RevokeOtherSessionsRequest) (*pb.RevokeOtherSessionsResponse, error) {
+	return g.client.RevokeOtherSessions(ctx, payload)
 }
 
 func (g *UserGateway) GetUser(ctx context.Context, payload *pb.GetUserRequest) (*pb.GetUserResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), UserServiceName, g.registry)
+	return g.client.GetUser(ctx, payload)
+}
+
+func (g *UserGateway) DeleteUser(ctx context.Context, payload *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	return g.client.DeleteUser(ctx, payload)
+}
+
+func (g *UserGateway) ListUsers(ctx context.Context, payload *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	return g.client.ListUsers(ctx, payload)
+}
+
+func (g *UserGateway) SetUserSuspended(ctx context.Context, payload *pb.SetUserSuspendedRequest) (*pb.SetUserSuspendedResponse, error) {
+	return g.client.SetUserSuspended(ctx, payload)
+}
+
+func (g *UserGateway) UnlockUser(ctx context.Context, payload *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	return g.client.UnlockUser(ctx, payload)
+}
+
+func (g *UserGateway) CreatePersonalAccessToken(ctx context.Context, payload *pb.CreatePersonalAccessTokenRequest) (*pb.CreatePersonalAccessTokenResponse, error) {
+	return g.client.CreatePersonalAccessToken(ctx, payload)
+}
+
+func (g *UserGateway) ListPersonalAccessTokens(ctx context.Context, payload *pb.ListPersonalAccessTokensRequest) (*pb.ListPersonalAccessTokensResponse, error) {
+	return g.client.ListPersonalAccessTokens(ctx, payload)
+}
+
+func (g *UserGateway) RevokePersonalAccessToken(ctx context.Context, payload *pb.RevokePersonalAccessTokenRequest) (*pb.RevokePersonalAccessTokenResponse, error) {
+	return g.client.RevokePersonalAccessToken(ctx, payload)
+}
+
+func (g *UserGateway) VerifyEmail(ctx context.Context, payload *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	return g.client.VerifyEmail(ctx, payload)
+}
+
+func (g *UserGateway) ResendVerificationEmail(ctx context.Context, payload *pb.ResendVerificationEmailRequest) (*pb.ResendVerificationEmailResponse, error) {
+	return g.client.ResendVerificationEmail(ctx, payload)
+}
+
+func (g *UserGateway) ChangePassword(ctx context.Context, payload *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	return g.client.ChangePassword(ctx, payload)
+}
+
+func (g *UserGateway) RequestPasswordReset(ctx context.Context, payload *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	return g.client.RequestPasswordReset(ctx, payload)
+}
+
+func (g *UserGateway) ResetPassword(ctx context.Context, payload *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	return g.client.ResetPassword(ctx, payload)
+}
+
+func (g *UserGateway) EnrollMFA(ctx context.Context, payload *pb.EnrollMFARequest) (*pb.EnrollMFAResponse, error) {
+	return g.client.EnrollMFA(ctx, payload)
+}
+
+func (g *UserGateway) ConfirmMFA(ctx context.Context, payload *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error) {
+	return g.client.ConfirmMFA(ctx, payload)
+}
+
+func (g *UserGateway) DisableMFA(ctx context.Context, payload *pb.DisableMFARequest) (*pb.DisableMFAResponse, error) {
+	return g.client.DisableMFA(ctx, payload)
+}
+
+func (g *UserGateway) VerifyMFA(ctx context.Context, payload *pb.VerifyMFARequest) (*pb.AuthUserResponse, error) {
+	return g.client.VerifyMFA(ctx, payload)
+}
+
+func (g *UserGateway) AuthIdentity(ctx context.Context, payload *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error) {
+	return g.client.AuthIdentity(ctx, payload)
+}
+
+// ExchangePersonalAccessToken implements auth.PersonalAccessTokenExchanger.
+func (g *UserGateway) ExchangePersonalAccessToken(ctx context.Context, token string) (string, time.Time, error) {
+	resp, err := g.client.ExchangePersonalAccessToken(ctx, &pb.ExchangePersonalAccessTokenRequest{Token: token})
 	if err != nil {
-		g.logger.Error(FailedToConnectUserError)
+		return "", time.Time{}, err
 	}
-	chatClient := pb.NewUserServiceClient(conn)
-	return chatClient.GetUser(ctx, payload)
+	return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
 }
 
-func (g *UserGateway) DeleteUser(ctx context.Context, payload *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
-	conn, err := common.ServiceConnection(context.Background(), UserServiceName, g.registry)
+func (g *UserGateway) JWKS(ctx context.Context) (*auth.JWKS, error) {
+	return auth.UserServiceJWKS(g.client)(ctx)
+}
+
+func (g *UserGateway) RevokedTokens(ctx context.Context, since time.Time) ([]auth.Revocation, error) {
+	var sinceMillis int64
+	if !since.IsZero() {
+		sinceMillis = since.UnixMilli()
+	}
+
+	resp, err := g.client.ListRevokedTokens(ctx, &pb.ListRevokedTokensRequest{Since: sinceMillis})
 	if err != nil {
-		g.logger.Error(FailedToConnectUserError)
+		return nil, err
 	}
-	chatClient := pb.NewUserServiceClient(conn)
-	return chatClient.DeleteUser(ctx, payload)
+
+	revocations := make([]auth.Revocation, 0, len(resp.Tokens))
+	for _, token := range resp.Tokens {
+		revocations = append(revocations, auth.Revocation{
+			TokenID:   token.TokenId,
+			ExpiresAt: time.Unix(token.ExpiresAt, 0),
+			RevokedAt: time.UnixMilli(token.RevokedAt),
+		})
+	}
+
+	return revocations, nil
 }
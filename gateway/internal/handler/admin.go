@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HJyup/mlt-gateway/internal/middleware"
+	"github.com/HJyup/mlt-gateway/internal/models"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/utils"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type AdminUserGateway interface {
+	ListUsers(context.Context, *pb.ListUsersRequest) (*pb.ListUsersResponse, error)
+	SetUserSuspended(context.Context, *pb.SetUserSuspendedRequest) (*pb.SetUserSuspendedResponse, error)
+	UnlockUser(context.Context, *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error)
+	GetUser(context.Context, *pb.GetUserRequest) (*pb.GetUserResponse, error)
+	DeleteUser(context.Context, *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error)
+}
+
+type AdminConfigurationGateway interface {
+	GetConfigurationMetadata(context.Context, *pb.GetConfigurationMetadataRequest) (*pb.GetConfigurationMetadataResponse, error)
+}
+
+// AdminHandler serves support tooling for operators. Every route requires the
+// admin role, which the user and configuration services verify again.
+type AdminHandler struct {
+	users         AdminUserGateway
+	configuration AdminConfigurationGateway
+	authenticate  mux.MiddlewareFunc
+}
+
+func NewAdminHandler(users AdminUserGateway, configuration AdminConfigurationGateway, authenticate mux.MiddlewareFunc) *AdminHandler {
+	return &AdminHandler{users: users, configuration: configuration, authenticate: authenticate}
+}
+
+func (h *AdminHandler) RegisterRoutes(router *mux.Router) {
+	adminRouter := router.PathPrefix("/api/v1/admin").Subrouter()
+	adminRouter.Use(h.authenticate, middleware.RequireRole(auth.RoleAdmin))
+	adminRouter.HandleFunc("/users", h.HandleListUsers).Methods("GET")
+	adminRouter.HandleFunc("/users/{userId}", h.HandleGetUser).Methods("GET")
+	adminRouter.HandleFunc("/users/{userId}", h.HandleDeleteUser).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{userId}/suspension", h.HandleSuspendUser).Methods("PUT")
+	adminRouter.HandleFunc("/users/{userId}/suspension", h.HandleReinstateUser).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{userId}/lockout", h.HandleUnlockUser).Methods("DELETE")
+	adminRouter.HandleFunc("/users/{userId}/configuration", h.HandleGetConfigurationMetadata).Methods("GET")
+}
+
+func (h *AdminHandler) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	resp, err := h.users.ListUsers(r.Context(), &pb.ListUsersRequest{
+		Limit:  int32(limit),
+		Offset: int32(offset),
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	users := make([]models.AdminUser, 0, len(resp.Users))
+	for _, user := range resp.Users {
+		adminUser := models.AdminUser{
+			UserID:    user.UserId,
+			Username:  user.Username,
+			Email:     user.Email,
+			Roles:     user.Roles,
+			CreatedAt: time.Unix(user.CreatedAt, 0).UTC(),
+		}
+		if user.SuspendedAt != 0 {
+			suspendedAt := time.Unix(user.SuspendedAt, 0).UTC()
+			adminUser.SuspendedAt = &suspendedAt
+		}
+		users = append(users, adminUser)
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string][]models.AdminUser{"users": users})
+}
+
+func (h *AdminHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.users.GetUser(r.Context(), &pb.GetUserRequest{
+		UserId: mux.Vars(r)["userId"],
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+func (h *AdminHandler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.users.DeleteUser(r.Context(), &pb.DeleteUserRequest{
+		UserId: mux.Vars(r)["userId"],
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *AdminHandler) HandleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, true)
+}
+
+func (h *AdminHandler) HandleReinstateUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, false)
+}
+
+func (h *AdminHandler) setSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	resp, err := h.users.SetUserSuspended(r.Context(), &pb.SetUserSuspendedRequest{
+		UserId:    mux.Vars(r)["userId"],
+		Suspended: suspended,
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *AdminHandler) HandleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.users.UnlockUser(r.Context(), &pb.UnlockUserRequest{
+		UserId: mux.Vars(r)["userId"],
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *AdminHandler) HandleGetConfigurationMetadata(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.configuration.GetConfigurationMetadata(r.Context(), &pb.GetConfigurationMetadataRequest{
+		UserId: mux.Vars(r)["userId"],
+	})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.NotFound:
+		utils.WriteError(w, http.StatusNotFound, "Not found")
+	case codes.PermissionDenied:
+		utils.WriteError(w, http.StatusForbidden, "Forbidden")
+	case codes.Unauthenticated:
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+	default:
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
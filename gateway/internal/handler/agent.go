@@ -9,25 +9,49 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HJyup/mlt-gateway/internal/middleware"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/requestid"
 	"github.com/HJyup/mtl-common/utils"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 )
 
+var tracer = otel.Tracer("github.com/HJyup/mlt-gateway/internal/handler")
+
 type AgentGateway interface {
 	AgentWebsocketStream(ctx context.Context, opts ...grpc.CallOption) (pb.AgentService_AgentWebsocketStreamClient, error)
 }
 
+// TokenRevocations notifies when a token is revoked.
+type TokenRevocations interface {
+	Subscribe(tokenID string) (<-chan struct{}, func())
+}
+
 type AgentHandler struct {
-	gateway  AgentGateway
-	upgrader websocket.Upgrader
+	gateway      AgentGateway
+	authenticate mux.MiddlewareFunc
+	revocations  TokenRevocations
+	upgrader     websocket.Upgrader
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewAgentHandler(gateway AgentGateway) *AgentHandler {
+func NewAgentHandler(gateway AgentGateway, authenticate mux.MiddlewareFunc, revocations TokenRevocations) *AgentHandler {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &AgentHandler{
-		gateway: gateway,
+		gateway:      gateway,
+		authenticate: authenticate,
+		revocations:  revocations,
+		ctx:          ctx,
+		cancel:       cancel,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -38,15 +62,22 @@ func NewAgentHandler(gateway AgentGateway) *AgentHandler {
 	}
 }
 
+// Shutdown closes every open websocket. Hijacked connections are not tracked by
+// http.Server.Shutdown, so this is registered with RegisterOnShutdown.
+func (h *AgentHandler) Shutdown() {
+	h.cancel()
+}
+
 func (h *AgentHandler) RegisterRoutes(router *mux.Router) {
 	agentRouter := router.PathPrefix("/api/v1/agents").Subrouter()
-	agentRouter.Handle("/ws", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleWebsocket))).Methods("GET")
+	agentRouter.Handle("/ws", h.authenticate(middleware.RequireScope(auth.ScopeAgentChat)(http.HandlerFunc(h.HandleWebsocket)))).Methods("GET")
 }
 
 type WebSocketMessage struct {
-	Type     string            `json:"type"`
-	Content  string            `json:"content"`
-	Metadata map[string]string `json:"metadata,omitempty"`
+	Type      string            `json:"type"`
+	Content   string            `json:"content"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
 }
 
 func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
@@ -56,6 +87,8 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	requestID := requestid.FromContext(r.Context())
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
@@ -63,14 +96,48 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	activeWebsockets.Inc()
+	defer activeWebsockets.Dec()
+
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Hour)
 	defer cancel()
 
+	closeConn := func(code int, reason string) {
+		cancel()
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(time.Second))
+		_ = conn.Close()
+	}
+
+	stopShutdown := context.AfterFunc(h.ctx, func() {
+		closeConn(websocket.CloseGoingAway, "server shutting down")
+	})
+	defer stopShutdown()
+
+	tokenID, _ := r.Context().Value("tokenID").(string)
+	sessionID, _ := r.Context().Value("sessionID").(string)
+	for _, id := range []string{tokenID, sessionID} {
+		if id == "" {
+			continue
+		}
+		revoked, unsubscribe := h.revocations.Subscribe(id)
+		defer unsubscribe()
+		go func() {
+			select {
+			case <-revoked:
+				closeConn(websocket.ClosePolicyViolation, "token revoked")
+			case <-ctx.Done():
+			}
+		}()
+	}
+
 	stream, err := h.gateway.AgentWebsocketStream(ctx)
 	if err != nil {
 		errorMsg := WebSocketMessage{
-			Type:    "ERROR",
-			Content: fmt.Sprintf("Failed to create agent stream: %v", err),
+			Type:      "ERROR",
+			RequestID: requestID,
+			Content:   fmt.Sprintf("Failed to create agent stream: %v", err),
 		}
 		conn.WriteJSON(errorMsg)
 		return
@@ -81,10 +148,11 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		UserId:  userID,
 		Content: "initial content",
 	}
-	if err = stream.Send(initMsg); err != nil {
+	if err = sendTraced(ctx, stream, initMsg); err != nil {
 		errorMsg := WebSocketMessage{
-			Type:    "ERROR",
-			Content: fmt.Sprintf("Failed to initialize agent: %v", err),
+			Type:      "ERROR",
+			RequestID: requestID,
+			Content:   fmt.Sprintf("Failed to initialize agent: %v", err),
 		}
 		conn.WriteJSON(errorMsg)
 		return
@@ -116,8 +184,9 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					log.Printf("Error receiving from stream: %v", err)
 					errorMsg := WebSocketMessage{
-						Type:    "ERROR",
-						Content: fmt.Sprintf("Stream error: %v", err),
+						Type:      "ERROR",
+						RequestID: requestID,
+						Content:   fmt.Sprintf("Stream error: %v", err),
 					}
 					conn.WriteJSON(errorMsg)
 					closeDone()
@@ -134,6 +203,7 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					wsMsg.Type = "AGENT_RESPONSE"
 				case pb.MessageType_ERROR:
 					wsMsg.Type = "ERROR"
+					wsMsg.RequestID = requestID
 				case pb.MessageType_CLOSE:
 					wsMsg.Type = "CLOSE"
 					closeDone()
@@ -168,7 +238,7 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						UserId:  userID,
 						Content: "Connection closed by client",
 					}
-					if err = stream.Send(closeMsg); err != nil {
+					if err = sendTraced(ctx, stream, closeMsg); err != nil {
 						log.Printf("Error sending close message: %v", err)
 					}
 					closeDone()
@@ -194,11 +264,12 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					Metadata: wsMsg.Metadata,
 				}
 
-				if err = stream.Send(grpcMsg); err != nil {
+				if err = sendTraced(ctx, stream, grpcMsg); err != nil {
 					log.Printf("Error sending to stream: %v", err)
 					errorMsg := WebSocketMessage{
-						Type:    "ERROR",
-						Content: fmt.Sprintf("Failed to send message: %v", err),
+						Type:      "ERROR",
+						RequestID: requestID,
+						Content:   fmt.Sprintf("Failed to send message: %v", err),
 					}
 					conn.WriteJSON(errorMsg)
 					closeDone()
@@ -210,3 +281,23 @@ func (h *AgentHandler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 
 	wg.Wait()
 }
+
+// sendTraced sends msg in its own span and injects that span's context into the
+// message metadata. The stream is long-lived, so per-message metadata is the only
+// way for the agent to attribute its work to an individual chat turn.
+func sendTraced(ctx context.Context, stream pb.AgentService_AgentWebsocketStreamClient, msg *pb.AgentMessage) error {
+	ctx, span := tracer.Start(ctx, "agent.send "+msg.Type.String(), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]string)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+
+	err := stream.Send(msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	return err
+}
@@ -3,10 +3,14 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"github.com/HJyup/mlt-gateway/internal/middleware"
 	"github.com/HJyup/mlt-gateway/internal/models"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
 	"github.com/HJyup/mtl-common/utils"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"net/http"
 )
@@ -19,19 +23,24 @@ type ConfigurationGateway interface {
 }
 
 type ConfigurationHandler struct {
-	gateway ConfigurationGateway
+	gateway      ConfigurationGateway
+	authenticate mux.MiddlewareFunc
 }
 
-func NewConfigurationHandler(gateway ConfigurationGateway) *ConfigurationHandler {
-	return &ConfigurationHandler{gateway: gateway}
+func NewConfigurationHandler(gateway ConfigurationGateway, authenticate mux.MiddlewareFunc) *ConfigurationHandler {
+	return &ConfigurationHandler{gateway: gateway, authenticate: authenticate}
 }
 
 func (h *ConfigurationHandler) RegisterRoutes(router *mux.Router) {
 	configRouter := router.PathPrefix("/api/v1/configurations").Subrouter()
-	configRouter.Handle("", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleCreateConfiguration))).Methods("POST")
-	configRouter.Handle("", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleUpdateConfiguration))).Methods("PUT")
-	configRouter.Handle("/{userId}", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleGetConfiguration))).Methods("GET")
-	configRouter.Handle("/{userId}", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleDeleteConfiguration))).Methods("DELETE")
+	configRouter.Handle("", h.scoped(auth.ScopeConfigWrite, h.HandleCreateConfiguration)).Methods("POST")
+	configRouter.Handle("", h.scoped(auth.ScopeConfigWrite, h.HandleUpdateConfiguration)).Methods("PUT")
+	configRouter.Handle("/{userId}", h.scoped(auth.ScopeConfigRead, h.HandleGetConfiguration)).Methods("GET")
+	configRouter.Handle("/{userId}", h.scoped(auth.ScopeConfigWrite, h.HandleDeleteConfiguration)).Methods("DELETE")
+}
+
+func (h *ConfigurationHandler) scoped(scope string, handler http.HandlerFunc) http.Handler {
+	return h.authenticate(middleware.RequireScope(scope)(handler))
 }
 
 func (h *ConfigurationHandler) HandleCreateConfiguration(w http.ResponseWriter, r *http.Request) {
@@ -45,7 +54,7 @@ func (h *ConfigurationHandler) HandleCreateConfiguration(w http.ResponseWriter,
 		UserId: userID,
 	})
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeConfigurationError(w, err)
 		return
 	}
 	utils.WriteJSON(w, http.StatusCreated, resp)
@@ -92,7 +101,7 @@ func (h *ConfigurationHandler) HandleUpdateConfiguration(w http.ResponseWriter,
 
 	resp, err := h.gateway.UpdateConfiguration(r.Context(), req)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeConfigurationError(w, err)
 		return
 	}
 
@@ -122,7 +131,7 @@ func (h *ConfigurationHandler) HandleGetConfiguration(w http.ResponseWriter, r *
 		UserId: userID,
 	})
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeConfigurationError(w, err)
 		return
 	}
 	utils.WriteJSON(w, http.StatusOK, resp)
@@ -146,7 +155,7 @@ func (h *ConfigurationHandler) HandleDeleteConfiguration(w http.ResponseWriter,
 		UserId: userID,
 	})
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeConfigurationError(w, err)
 		return
 	}
 
@@ -157,3 +166,16 @@ func (h *ConfigurationHandler) HandleDeleteConfiguration(w http.ResponseWriter,
 
 	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
 }
+
+// writeConfigurationError answers a failed configuration service call, keeping
+// auth rejections from the service interceptor out of the 500 range.
+func writeConfigurationError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		utils.WriteError(w, http.StatusForbidden, "Forbidden")
+	case codes.Unauthenticated:
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+	default:
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/utils"
+	"github.com/gorilla/mux"
+)
+
+type JWKSSource interface {
+	JWKS() *auth.JWKS
+}
+
+type JWKSHandler struct {
+	source JWKSSource
+}
+
+func NewJWKSHandler(source JWKSSource) *JWKSHandler {
+	return &JWKSHandler{source: source}
+}
+
+func (h *JWKSHandler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/.well-known/jwks.json", h.HandleGetJWKS).Methods("GET")
+}
+
+func (h *JWKSHandler) HandleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, h.source.JWKS())
+}
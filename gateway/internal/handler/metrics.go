@@ -0,0 +1,11 @@
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var activeWebsockets = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "gateway_agent_websockets_active",
+	Help: "Number of open agent websocket connections.",
+})
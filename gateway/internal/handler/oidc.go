@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HJyup/mlt-gateway/internal/oidc"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/utils"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	oidcCookieName = "mtl_oidc"
+	// oidcFlowTimeout is how long the user has to complete the provider's
+	// sign in before the flow cookie expires.
+	oidcFlowTimeout = 10 * time.Minute
+)
+
+type IdentityGateway interface {
+	AuthIdentity(context.Context, *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error)
+}
+
+// OIDCHandler signs users in through external OpenID Connect providers with
+// the authorization code flow and PKCE. The state, nonce and code verifier
+// are kept in a cookie scoped to the provider's routes, so the callback can
+// be served by any gateway instance and must come from the browser that
+// started the flow.
+type OIDCHandler struct {
+	providers map[string]*oidc.Provider
+	users     IdentityGateway
+}
+
+func NewOIDCHandler(providers []*oidc.Provider, users IdentityGateway) *OIDCHandler {
+	byName := make(map[string]*oidc.Provider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name()] = provider
+	}
+	return &OIDCHandler{providers: byName, users: users}
+}
+
+func (h *OIDCHandler) RegisterRoutes(router *mux.Router) {
+	oidcRouter := router.PathPrefix("/api/v1/users/oidc").Subrouter()
+	oidcRouter.HandleFunc("/{provider}/login", h.HandleLogin).Methods("GET")
+	oidcRouter.HandleFunc("/{provider}/callback", h.HandleCallback).Methods("GET")
+}
+
+func (h *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	var flow [3]string
+	for i := range flow {
+		value, err := oidc.RandomString()
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, "Failed to start sign in")
+			return
+		}
+		flow[i] = value
+	}
+	state, nonce, verifier := flow[0], flow[1], flow[2]
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to start OIDC sign in with %s: %v", provider.Name(), err)
+		utils.WriteError(w, http.StatusBadGateway, "Identity provider unavailable")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    strings.Join(flow[:], "."),
+		Path:     oidcCookiePath(provider),
+		MaxAge:   int(oidcFlowTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// Lax, so the cookie is sent on the provider's top-level redirect back.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *OIDCHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Sign in was not started or has expired")
+		return
+	}
+	// The flow is single-use, whatever the outcome.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Path:     oidcCookiePath(provider),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	flow := strings.Split(cookie.Value, ".")
+	query := r.URL.Query()
+	if len(flow) != 3 || subtle.ConstantTimeCompare([]byte(flow[0]), []byte(query.Get("state"))) != 1 {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid sign in state")
+		return
+	}
+	nonce, verifier := flow[1], flow[2]
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		utils.WriteError(w, http.StatusUnauthorized, "Sign in failed: "+providerErr)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Authorization code is required")
+		return
+	}
+
+	idToken, err := provider.Exchange(r.Context(), code, verifier)
+	if err != nil {
+		log.Printf("Failed to exchange OIDC code with %s: %v", provider.Name(), err)
+		utils.WriteError(w, http.StatusUnauthorized, "Sign in failed")
+		return
+	}
+	identity, err := provider.VerifyIDToken(r.Context(), idToken, nonce)
+	if err != nil {
+		log.Printf("Rejected OIDC ID token from %s: %v", provider.Name(), err)
+		utils.WriteError(w, http.StatusUnauthorized, "Sign in failed")
+		return
+	}
+
+	resp, err := h.users.AuthIdentity(r.Context(), &pb.AuthIdentityRequest{
+		Provider:      provider.Name(),
+		Subject:       identity.Subject,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+		Username:      identity.Username,
+		UserAgent:     r.UserAgent(),
+		IpAddress:     clientIP(r),
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			utils.WriteError(w, http.StatusBadRequest, "Identity provider did not share an email address")
+		case codes.FailedPrecondition:
+			utils.WriteError(w, http.StatusForbidden, "Email address is not verified by the identity provider")
+		case codes.PermissionDenied:
+			utils.WriteError(w, http.StatusForbidden, "Account suspended")
+		default:
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	// As with a password, the sign-in is not complete until the MFA challenge
+	// is answered at /api/v1/users/sign-in/mfa.
+	if resp.MfaRequired {
+		utils.WriteJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+func oidcCookiePath(provider *oidc.Provider) string {
+	return "/api/v1/users/oidc/" + provider.Name()
+}
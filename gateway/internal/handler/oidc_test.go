@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/HJyup/mlt-gateway/internal/oidc"
+	"github.com/HJyup/mlt-gateway/internal/oidc/oidctest"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+)
+
+type fakeIdentityGateway struct {
+	requests []*pb.AuthIdentityRequest
+	resp     *pb.AuthIdentityResponse
+}
+
+func (g *fakeIdentityGateway) AuthIdentity(_ context.Context, req *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error) {
+	g.requests = append(g.requests, req)
+	if g.resp != nil {
+		return g.resp, nil
+	}
+	return &pb.AuthIdentityResponse{UserId: "user-1", Token: "access", RefreshToken: "refresh"}, nil
+}
+
+type oidcTest struct {
+	idp    *oidctest.Provider
+	users  *fakeIdentityGateway
+	router *mux.Router
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+
+	idp, err := oidctest.NewProvider()
+	if err != nil {
+		t.Fatalf("start provider: %v", err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider := oidc.NewProvider(oidc.ProviderConfig{
+		Name:         "test",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://gateway.example/api/v1/users/oidc/test/callback",
+	}, nil)
+
+	users := &fakeIdentityGateway{}
+	router := mux.NewRouter()
+	NewOIDCHandler([]*oidc.Provider{provider}, users).RegisterRoutes(router)
+
+	return &oidcTest{idp: idp, users: users, router: router}
+}
+
+// login starts a flow and signs in at the provider, returning the flow cookie
+// and the query the provider redirects back with.
+func (o *oidcTest) login(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/users/oidc/test/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login did not set the flow cookie")
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.Path != "/api/v1/users/oidc/test" {
+		t.Errorf("flow cookie = %+v, want HttpOnly, Secure and scoped to the provider", cookie)
+	}
+
+	code, state, err := o.idp.Authorize(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	return cookie, url.Values{"code": {code}, "state": {state}}
+}
+
+func (o *oidcTest) callback(cookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/oidc/test/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCCallbackSignsIn(t *testing.T) {
+	o := newOIDCTest(t)
+
+	cookie, query := o.login(t)
+	rec := o.callback(cookie, query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	if len(o.users.requests) != 1 {
+		t.Fatalf("AuthIdentity called %d times, want 1", len(o.users.requests))
+	}
+	req := o.users.requests[0]
+	if req.Provider != "test" || req.Subject != o.idp.User.Subject || req.Email != o.idp.User.Email || !req.EmailVerified {
+		t.Errorf("AuthIdentity request = %+v", req)
+	}
+
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("callback did not clear the flow cookie")
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare may change the provider, the cookie or the callback query
+		// before the callback is served.
+		prepare func(t *testing.T, o *oidcTest, cookie *http.Cookie, query url.Values) *http.Cookie
+		want    int
+	}{
+		{
+			name: "state mismatch",
+			prepare: func(_ *testing.T, _ *oidcTest, cookie *http.Cookie, query url.Values) *http.Cookie {
+				query.Set("state", "forged-state")
+				return cookie
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "missing flow cookie",
+			prepare: func(*testing.T, *oidcTest, *http.Cookie, url.Values) *http.Cookie {
+				return nil
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "cookie from another flow",
+			prepare: func(t *testing.T, o *oidcTest, _ *http.Cookie, _ url.Values) *http.Cookie {
+				other, _ := o.login(t)
+				return other
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			prepare: func(_ *testing.T, o *oidcTest, cookie *http.Cookie, _ url.Values) *http.Cookie {
+				o.idp.Claims = func(c jwt.MapClaims) { c["nonce"] = "other-nonce" }
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong issuer",
+			prepare: func(_ *testing.T, o *oidcTest, cookie *http.Cookie, _ url.Values) *http.Cookie {
+				o.idp.Claims = func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" }
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong audience",
+			prepare: func(_ *testing.T, o *oidcTest, cookie *http.Cookie, _ url.Values) *http.Cookie {
+				o.idp.Claims = func(c jwt.MapClaims) { c["aud"] = "other-client" }
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong authorized party",
+			prepare: func(_ *testing.T, o *oidcTest, cookie *http.Cookie, _ url.Values) *http.Cookie {
+				o.idp.Claims = func(c jwt.MapClaims) {
+					c["aud"] = []string{oidctest.ClientID, "other-client"}
+					c["azp"] = "other-client"
+				}
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "expired id token",
+			prepare: func(_ *testing.T, o *oidcTest, cookie *http.Cookie, _ url.Values) *http.Cookie {
+				o.idp.Claims = func(c jwt.MapClaims) { c["exp"] = c["iat"] }
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "provider error",
+			prepare: func(_ *testing.T, _ *oidcTest, cookie *http.Cookie, query url.Values) *http.Cookie {
+				query.Del("code")
+				query.Set("error", "access_denied")
+				return cookie
+			},
+			want: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOIDCTest(t)
+
+			cookie, query := o.login(t)
+			cookie = tt.prepare(t, o, cookie, query)
+
+			rec := o.callback(cookie, query)
+			if rec.Code != tt.want {
+				t.Errorf("callback status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if len(o.users.requests) != 0 {
+				t.Errorf("AuthIdentity called for a rejected sign in: %+v", o.users.requests)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsReusedFlow(t *testing.T) {
+	o := newOIDCTest(t)
+
+	cookie, query := o.login(t)
+	if rec := o.callback(cookie, query); rec.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	// A browser drops the cleared cookie, but a replayed request may still
+	// carry it together with the code it was issued for.
+	if rec := o.callback(cookie, query); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replayed callback status = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if len(o.users.requests) != 1 {
+		t.Errorf("AuthIdentity called %d times, want 1", len(o.users.requests))
+	}
+}
+
+func TestOIDCUnknownProvider(t *testing.T) {
+	o := newOIDCTest(t)
+
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/users/oidc/other/login", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("login status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestOIDCCallbackRequiresMFA(t *testing.T) {
+	o := newOIDCTest(t)
+	o.users.resp = &pb.AuthIdentityResponse{MfaRequired: true, MfaToken: "mfa-token"}
+
+	cookie, query := o.login(t)
+	rec := o.callback(cookie, query)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("callback status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+
+	var resp pb.AuthIdentityResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if !resp.MfaRequired || resp.MfaToken != "mfa-token" || resp.Token != "" {
+		t.Errorf("response = %+v, want an MFA challenge without tokens", &resp)
+	}
+}
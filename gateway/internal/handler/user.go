@@ -3,35 +3,91 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"github.com/HJyup/mlt-gateway/internal/middleware"
 	"github.com/HJyup/mlt-gateway/internal/models"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
 	"github.com/HJyup/mtl-common/utils"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"net"
 	"net/http"
+	"time"
 )
 
 type UserGateway interface {
 	CreatUser(ctx context.Context, payload *pb.CreateUserRequest) (*pb.CreateUserResponse, error)
 	AuthUser(ctx context.Context, payload *pb.AuthUserRequest) (*pb.AuthUserResponse, error)
+	RefreshToken(ctx context.Context, payload *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error)
+	Logout(ctx context.Context, payload *pb.LogoutRequest) (*pb.LogoutResponse, error)
+	ListSessions(ctx context.Context, payload *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error)
+	RevokeSession(ctx context.Context, payload *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error)
+	RevokeOtherSessions(ctx context.Context, payload *pb.RevokeOtherSessionsRequest) (*pb.RevokeOtherSessionsResponse, error)
 	GetUser(context.Context, *pb.GetUserRequest) (*pb.GetUserResponse, error)
 	DeleteUser(context.Context, *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error)
+	CreatePersonalAccessToken(context.Context, *pb.CreatePersonalAccessTokenRequest) (*pb.CreatePersonalAccessTokenResponse, error)
+	ListPersonalAccessTokens(context.Context, *pb.ListPersonalAccessTokensRequest) (*pb.ListPersonalAccessTokensResponse, error)
+	RevokePersonalAccessToken(context.Context, *pb.RevokePersonalAccessTokenRequest) (*pb.RevokePersonalAccessTokenResponse, error)
+	VerifyEmail(context.Context, *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error)
+	ResendVerificationEmail(context.Context, *pb.ResendVerificationEmailRequest) (*pb.ResendVerificationEmailResponse, error)
+	ChangePassword(context.Context, *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error)
+	RequestPasswordReset(context.Context, *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error)
+	ResetPassword(context.Context, *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error)
+	EnrollMFA(context.Context, *pb.EnrollMFARequest) (*pb.EnrollMFAResponse, error)
+	ConfirmMFA(context.Context, *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error)
+	DisableMFA(context.Context, *pb.DisableMFARequest) (*pb.DisableMFAResponse, error)
+	VerifyMFA(context.Context, *pb.VerifyMFARequest) (*pb.AuthUserResponse, error)
+}
+
+// TokenDenylist records a revocation in this gateway without waiting for the
+// next denylist sync.
+type TokenDenylist interface {
+	Add(tokenID string, expiresAt time.Time)
 }
 
 type UserHandler struct {
-	gateway UserGateway
+	gateway      UserGateway
+	authenticate mux.MiddlewareFunc
+	denylist     TokenDenylist
 }
 
-func NewUserHandler(gateway UserGateway) *UserHandler {
-	return &UserHandler{gateway: gateway}
+func NewUserHandler(gateway UserGateway, authenticate mux.MiddlewareFunc, denylist TokenDenylist) *UserHandler {
+	return &UserHandler{gateway: gateway, authenticate: authenticate, denylist: denylist}
 }
 
 func (h *UserHandler) RegisterRoutes(router *mux.Router) {
 	userRouter := router.PathPrefix("/api/v1/users").Subrouter()
 	userRouter.HandleFunc("/sign-up", h.HandleCreateUser).Methods("POST")
 	userRouter.HandleFunc("/sign-in", h.HandleAuthUser).Methods("POST")
-	userRouter.Handle("/{userId}", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleGetUser))).Methods("GET")
-	userRouter.Handle("/{userId}", utils.TokenAuthMiddleware(http.HandlerFunc(h.HandleDeleteUser))).Methods("DELETE")
+	userRouter.HandleFunc("/sign-in/mfa", h.HandleVerifyMFA).Methods("POST")
+	userRouter.HandleFunc("/refresh", h.HandleRefreshToken).Methods("POST")
+	userRouter.HandleFunc("/verify-email", h.HandleVerifyEmail).Methods("POST")
+	userRouter.HandleFunc("/verify-email/resend", h.HandleResendVerificationEmail).Methods("POST")
+	userRouter.HandleFunc("/password-reset", h.HandleRequestPasswordReset).Methods("POST")
+	userRouter.HandleFunc("/password-reset/confirm", h.HandleResetPassword).Methods("POST")
+	userRouter.Handle("/sign-out", h.session(h.HandleSignOut)).Methods("POST")
+	// Registered before /{userId} so that "password", "mfa", "sessions" and
+	// "tokens" are not taken for a user ID.
+	userRouter.Handle("/password", h.session(h.HandleChangePassword)).Methods("PUT")
+	userRouter.Handle("/mfa", h.session(h.HandleEnrollMFA)).Methods("POST")
+	userRouter.Handle("/mfa", h.session(h.HandleDisableMFA)).Methods("DELETE")
+	userRouter.Handle("/mfa/confirm", h.session(h.HandleConfirmMFA)).Methods("POST")
+	userRouter.Handle("/sessions", h.session(h.HandleListSessions)).Methods("GET")
+	userRouter.Handle("/sessions", h.session(h.HandleRevokeOtherSessions)).Methods("DELETE")
+	userRouter.Handle("/sessions/{sessionId}", h.session(h.HandleRevokeSession)).Methods("DELETE")
+	userRouter.Handle("/tokens", h.session(h.HandleListPersonalAccessTokens)).Methods("GET")
+	userRouter.Handle("/tokens", h.session(h.HandleCreatePersonalAccessToken)).Methods("POST")
+	userRouter.Handle("/tokens/{tokenId}", h.session(h.HandleRevokePersonalAccessToken)).Methods("DELETE")
+	userRouter.Handle("/{userId}", h.authenticate(middleware.RequireScope(auth.ScopeUsersRead)(http.HandlerFunc(h.HandleGetUser)))).Methods("GET")
+	userRouter.Handle("/{userId}", h.session(h.HandleDeleteUser)).Methods("DELETE")
+}
+
+// session authenticates routes that manage the account, which a personal
+// access token may not.
+func (h *UserHandler) session(handler http.HandlerFunc) http.Handler {
+	return h.authenticate(middleware.RequireSession(handler))
 }
 
 func (h *UserHandler) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +111,14 @@ func (h *UserHandler) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 		Password: reqBody.Password,
 	})
 	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			utils.WriteError(w, http.StatusBadRequest, "Invalid email address")
+			return
+		case codes.AlreadyExists:
+			utils.WriteError(w, http.StatusConflict, "Email is already registered")
+			return
+		}
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -77,16 +141,488 @@ func (h *UserHandler) HandleAuthUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp, err := h.gateway.AuthUser(r.Context(), &pb.AuthUserRequest{
-		Email:    reqBody.Email,
-		Password: reqBody.Password,
+		Email:     reqBody.Email,
+		Password:  reqBody.Password,
+		UserAgent: r.UserAgent(),
+		IpAddress: clientIP(r),
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unauthenticated:
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid email or password")
+			return
+		case codes.ResourceExhausted:
+			utils.WriteError(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later")
+			return
+		case codes.PermissionDenied:
+			utils.WriteError(w, http.StatusForbidden, "Account suspended")
+			return
+		case codes.FailedPrecondition:
+			utils.WriteError(w, http.StatusForbidden, "Email address is not verified")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// The sign-in is not complete until the MFA challenge is answered at
+	// /sign-in/mfa.
+	if resp.MfaRequired {
+		utils.WriteJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, resp)
+}
+
+func (h *UserHandler) HandleVerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.VerifyMFARequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.MFAToken == "" || reqBody.Code == "" {
+		utils.WriteError(w, http.StatusBadRequest, "MFA token and code are required")
+		return
+	}
+
+	resp, err := h.gateway.VerifyMFA(r.Context(), &pb.VerifyMFARequest{
+		MfaToken: reqBody.MFAToken,
+		Code:     reqBody.Code,
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			utils.WriteError(w, http.StatusBadRequest, "Invalid code")
+			return
+		case codes.Unauthenticated:
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+			return
+		case codes.ResourceExhausted:
+			utils.WriteError(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later")
+			return
+		case codes.PermissionDenied:
+			utils.WriteError(w, http.StatusForbidden, "Account suspended")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, resp)
+}
+
+func (h *UserHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.VerifyEmailRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Token == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	resp, err := h.gateway.VerifyEmail(r.Context(), &pb.VerifyEmailRequest{
+		Token: reqBody.Token,
+	})
+	if err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			utils.WriteError(w, http.StatusBadRequest, "Invalid or expired verification token")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.ResendVerificationEmailRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Email == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	resp, err := h.gateway.ResendVerificationEmail(r.Context(), &pb.ResendVerificationEmailRequest{
+		Email: reqBody.Email,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusAccepted, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var reqBody models.ChangePasswordRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.CurrentPassword == "" || reqBody.NewPassword == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Current and new password are required")
+		return
+	}
+
+	resp, err := h.gateway.ChangePassword(r.Context(), &pb.ChangePasswordRequest{
+		UserId:          userID,
+		CurrentPassword: reqBody.CurrentPassword,
+		NewPassword:     reqBody.NewPassword,
 	})
 	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			utils.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+			return
+		case codes.PermissionDenied:
+			utils.WriteError(w, http.StatusForbidden, "Current password is incorrect")
+			return
+		case codes.ResourceExhausted:
+			utils.WriteError(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later")
+			return
+		}
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	utils.WriteJSON(w, http.StatusOK, map[string]int64{"revoked": resp.Revoked})
+}
+
+func (h *UserHandler) HandleEnrollMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	resp, err := h.gateway.EnrollMFA(r.Context(), &pb.EnrollMFARequest{
+		UserId: userID,
+	})
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
 	utils.WriteJSON(w, http.StatusCreated, resp)
 }
 
+func (h *UserHandler) HandleConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var reqBody models.MFACodeRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Code == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	resp, err := h.gateway.ConfirmMFA(r.Context(), &pb.ConfirmMFARequest{
+		UserId: userID,
+		Code:   reqBody.Code,
+	})
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string][]string{"recovery_codes": resp.RecoveryCodes})
+}
+
+func (h *UserHandler) HandleDisableMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var reqBody models.MFACodeRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Code == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	resp, err := h.gateway.DisableMFA(r.Context(), &pb.DisableMFARequest{
+		UserId: userID,
+		Code:   reqBody.Code,
+	})
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.RequestPasswordResetRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Email == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	resp, err := h.gateway.RequestPasswordReset(r.Context(), &pb.RequestPasswordResetRequest{
+		Email: reqBody.Email,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusAccepted, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.ResetPasswordRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Token == "" || reqBody.NewPassword == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Token and new password are required")
+		return
+	}
+
+	resp, err := h.gateway.ResetPassword(r.Context(), &pb.ResetPasswordRequest{
+		Token:       reqBody.Token,
+		NewPassword: reqBody.NewPassword,
+	})
+	if err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			utils.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.RefreshTokenRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.RefreshToken == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Refresh token is required")
+		return
+	}
+
+	resp, err := h.gateway.RefreshToken(r.Context(), &pb.RefreshTokenRequest{
+		RefreshToken: reqBody.RefreshToken,
+	})
+	if err != nil {
+		if status.Code(err) == codes.Unauthenticated {
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid refresh token")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+func (h *UserHandler) HandleSignOut(w http.ResponseWriter, r *http.Request) {
+	var reqBody models.SignOutRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &reqBody); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	}
+
+	token, err := utils.BearerToken(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	resp, err := h.gateway.Logout(r.Context(), &pb.LogoutRequest{
+		Token:        token,
+		RefreshToken: reqBody.RefreshToken,
+	})
+	if err != nil {
+		if status.Code(err) == codes.Unauthenticated {
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.denylist.Add(resp.TokenId, time.Unix(resp.ExpiresAt, 0))
+
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	currentSessionID, _ := r.Context().Value("sessionID").(string)
+
+	resp, err := h.gateway.ListSessions(r.Context(), &pb.ListSessionsRequest{
+		UserId: userID,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sessions := make([]models.Session, 0, len(resp.Sessions))
+	for _, session := range resp.Sessions {
+		sessions = append(sessions, models.Session{
+			SessionID:  session.SessionId,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IpAddress,
+			CreatedAt:  time.Unix(session.CreatedAt, 0).UTC(),
+			LastSeenAt: time.Unix(session.LastSeenAt, 0).UTC(),
+			Current:    session.SessionId == currentSessionID,
+		})
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string][]models.Session{"sessions": sessions})
+}
+
+func (h *UserHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	resp, err := h.gateway.RevokeSession(r.Context(), &pb.RevokeSessionRequest{
+		UserId:    userID,
+		SessionId: mux.Vars(r)["sessionId"],
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			utils.WriteError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+func (h *UserHandler) HandleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	currentSessionID, _ := r.Context().Value("sessionID").(string)
+
+	resp, err := h.gateway.RevokeOtherSessions(r.Context(), &pb.RevokeOtherSessionsRequest{
+		UserId:           userID,
+		CurrentSessionId: currentSessionID,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]int64{"revoked": resp.Revoked})
+}
+
 func (h *UserHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userId := vars["userId"]
@@ -99,6 +635,10 @@ func (h *UserHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 		UserId: userId,
 	})
 	if err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			utils.WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -133,3 +673,125 @@ func (h *UserHandler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
 }
+
+func (h *UserHandler) HandleCreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var reqBody models.CreatePersonalAccessTokenRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err = json.Unmarshal(body, &reqBody); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Scopes) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, "Name and scopes are required")
+		return
+	}
+
+	resp, err := h.gateway.CreatePersonalAccessToken(r.Context(), &pb.CreatePersonalAccessTokenRequest{
+		UserId:    userID,
+		Name:      reqBody.Name,
+		Scopes:    reqBody.Scopes,
+		ExpiresIn: reqBody.ExpiresIn,
+	})
+	if err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			utils.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, resp)
+}
+
+func (h *UserHandler) HandleListPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	resp, err := h.gateway.ListPersonalAccessTokens(r.Context(), &pb.ListPersonalAccessTokensRequest{
+		UserId: userID,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tokens := make([]models.PersonalAccessToken, 0, len(resp.Tokens))
+	for _, token := range resp.Tokens {
+		item := models.PersonalAccessToken{
+			TokenID:   token.TokenId,
+			Name:      token.Name,
+			Scopes:    token.Scopes,
+			CreatedAt: time.Unix(token.CreatedAt, 0).UTC(),
+			ExpiresAt: time.Unix(token.ExpiresAt, 0).UTC(),
+		}
+		if token.LastUsedAt != 0 {
+			lastUsedAt := time.Unix(token.LastUsedAt, 0).UTC()
+			item.LastUsedAt = &lastUsedAt
+		}
+		tokens = append(tokens, item)
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string][]models.PersonalAccessToken{"tokens": tokens})
+}
+
+func (h *UserHandler) HandleRevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	resp, err := h.gateway.RevokePersonalAccessToken(r.Context(), &pb.RevokePersonalAccessTokenRequest{
+		UserId:  userID,
+		TokenId: mux.Vars(r)["tokenId"],
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			utils.WriteError(w, http.StatusNotFound, "Token not found")
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]bool{"success": resp.Success})
+}
+
+// writeMFAError answers a failed MFA management call.
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		utils.WriteError(w, http.StatusBadRequest, "Invalid code")
+	case codes.AlreadyExists:
+		utils.WriteError(w, http.StatusConflict, "MFA is already enabled")
+	case codes.FailedPrecondition:
+		utils.WriteError(w, http.StatusConflict, status.Convert(err).Message())
+	case codes.ResourceExhausted:
+		utils.WriteError(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later")
+	default:
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// clientIP is the address of the direct peer. X-Forwarded-For is not trusted,
+// since the gateway does not know which proxies sit in front of it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/HJyup/mtl-common/utils"
+	"github.com/gorilla/mux"
+)
+
+// RequireRole rejects requests whose token does not carry role. It must run
+// after the token auth middleware, which puts the roles claim in the context.
+// Services check roles again, so this only saves them the round trip.
+func RequireRole(role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			roles, _ := r.Context().Value("roles").([]string)
+			if !slices.Contains(roles, role) {
+				utils.WriteError(w, http.StatusForbidden, "Forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/utils"
+	"github.com/gorilla/mux"
+)
+
+// RequireScope rejects requests made with a personal access token that was not
+// granted scope. Tokens from signing in carry no scopes and always pass. Like
+// RequireRole, it must run after the token auth middleware.
+func RequireScope(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopes, _ := r.Context().Value("scopes").([]string)
+			if !auth.HasScope(scopes, scope) {
+				utils.WriteError(w, http.StatusForbidden, "Token is missing scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession rejects requests made with a personal access token, for
+// routes that manage the account itself.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scopes, _ := r.Context().Value("scopes").([]string); len(scopes) > 0 {
+			utils.WriteError(w, http.StatusForbidden, "Personal access tokens cannot be used here")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,205 @@
+// Package oidctest runs a minimal OpenID Connect provider for tests. It serves
+// discovery, a JWKS and a token endpoint that enforces PKCE, and signs ID
+// tokens that tests can tamper with before they are issued.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ClientID     = "test-client"
+	ClientSecret = "test-secret"
+	keyID        = "test-key"
+)
+
+// User is who signs in at the provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+type Provider struct {
+	// User is asserted in every ID token.
+	User User
+	// Claims, if set, may change an ID token's claims before it is signed.
+	Claims func(claims jwt.MapClaims)
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+// NewProvider starts a provider. Close it when the test is done.
+func NewProvider() (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		User: User{
+			Subject:       "subject-1",
+			Email:         "user@example.com",
+			EmailVerified: true,
+			Username:      "user",
+		},
+		key:   key,
+		codes: make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /jwks", p.handleJWKS)
+	mux.HandleFunc("POST /token", p.handleToken)
+	p.server = httptest.NewServer(mux)
+
+	return p, nil
+}
+
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+// Authorize stands in for the user signing in at the provider: it takes the
+// URL the browser was sent to and returns the code and state the provider
+// would redirect back with.
+func (p *Provider) Authorize(authURL string) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	query := u.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != ClientID {
+		return "", "", fmt.Errorf("unexpected authorization request %q", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		return "", "", fmt.Errorf("authorization request without an S256 code challenge")
+	}
+
+	code = randomString()
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+	}
+	p.mu.Unlock()
+
+	return code, query.Get("state"), nil
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer(),
+		"authorization_endpoint": p.Issuer() + "/authorize",
+		"token_endpoint":         p.Issuer() + "/token",
+		"jwks_uri":               p.Issuer() + "/jwks",
+	})
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	public := p.key.PublicKey
+	writeJSON(w, http.StatusOK, auth.JWKS{Keys: []auth.JWK{{
+		KeyID:     keyID,
+		KeyType:   "RSA",
+		Algorithm: auth.AlgorithmRS256,
+		Use:       "sig",
+		N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}}})
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if id, secret, _ := r.BasicAuth(); id != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// Codes are single-use, as at a real provider.
+	p.mu.Lock()
+	code := r.PostForm.Get("code")
+	authz, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || authz.redirectURI != r.PostForm.Get("redirect_uri") ||
+		authz.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                p.Issuer(),
+		"sub":                p.User.Subject,
+		"aud":                ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              authz.nonce,
+		"email":              p.User.Email,
+		"email_verified":     p.User.EmailVerified,
+		"preferred_username": p.User.Username,
+	}
+	if p.Claims != nil {
+		p.Claims(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,199 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/HJyup/mlt-gateway/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+
+	idp, err := oidctest.NewProvider()
+	if err != nil {
+		t.Fatalf("start provider: %v", err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider := NewProvider(ProviderConfig{
+		Name:         "test",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://gateway.example/api/v1/users/oidc/test/callback",
+	}, nil)
+	return idp, provider
+}
+
+// signIn runs the flow up to the ID token, as the callback would.
+func signIn(t *testing.T, idp *oidctest.Provider, provider *Provider, nonce string) (string, error) {
+	t.Helper()
+
+	ctx := context.Background()
+	verifier := "verifier-" + nonce
+	authURL, err := provider.AuthCodeURL(ctx, "state", nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	return provider.Exchange(ctx, code, verifier)
+}
+
+func TestAuthCodeURLSendsS256Challenge(t *testing.T) {
+	_, provider := newTestProvider(t)
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", authURL, err)
+	}
+
+	query := u.Query()
+	sum := sha256.Sum256([]byte("verifier"))
+	if got, want := query.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("code_challenge = %q, want %q", got, want)
+	}
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", got)
+	}
+	if query.Get("state") != "state" || query.Get("nonce") != "nonce" {
+		t.Errorf("state and nonce not passed through: %q", authURL)
+	}
+	if query.Get("code_verifier") != "" {
+		t.Errorf("verifier leaked into the authorization URL: %q", authURL)
+	}
+}
+
+func TestExchangeRequiresMatchingVerifier(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, _, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	if _, err = provider.Exchange(ctx, code, "other-verifier"); err == nil {
+		t.Fatal("Exchange with the wrong verifier succeeded")
+	}
+
+	authURL, _ = provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	code, _, _ = idp.Authorize(authURL)
+	idToken, err := provider.Exchange(ctx, code, "verifier")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err = provider.Exchange(ctx, code, "verifier"); err == nil {
+		t.Error("authorization code was redeemed twice")
+	}
+
+	identity, err := provider.VerifyIDToken(ctx, idToken, "nonce")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if identity.Subject != idp.User.Subject || identity.Email != idp.User.Email ||
+		!identity.EmailVerified || identity.Username != idp.User.Username {
+		t.Errorf("identity = %+v, want %+v", identity, idp.User)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(jwt.MapClaims)
+		nonce  string
+		want   error
+	}{
+		{
+			name:  "nonce mismatch",
+			nonce: "other-nonce",
+			want:  ErrNonceMismatch,
+		},
+		{
+			name:   "missing nonce",
+			claims: func(c jwt.MapClaims) { delete(c, "nonce") },
+			want:   ErrNonceMismatch,
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" },
+			want:   ErrInvalidIDToken,
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c jwt.MapClaims) { c["aud"] = "other-client" },
+			want:   ErrInvalidIDToken,
+		},
+		{
+			name: "wrong authorized party",
+			claims: func(c jwt.MapClaims) {
+				c["aud"] = []string{oidctest.ClientID, "other-client"}
+				c["azp"] = "other-client"
+			},
+			want: ErrInvalidIDToken,
+		},
+		{
+			name:   "expired",
+			claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+			want:   ErrInvalidIDToken,
+		},
+		{
+			name:   "no expiry",
+			claims: func(c jwt.MapClaims) { delete(c, "exp") },
+			want:   ErrInvalidIDToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp, provider := newTestProvider(t)
+			idp.Claims = tt.claims
+
+			idToken, err := signIn(t, idp, provider, "nonce")
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+
+			nonce := "nonce"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+			if _, err = provider.VerifyIDToken(context.Background(), idToken, nonce); !errors.Is(err, tt.want) {
+				t.Errorf("VerifyIDToken error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAcceptsMatchingAuthorizedParty(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	idp.Claims = func(c jwt.MapClaims) {
+		c["aud"] = []string{oidctest.ClientID, "other-client"}
+		c["azp"] = oidctest.ClientID
+	}
+
+	idToken, err := signIn(t, idp, provider, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err = provider.VerifyIDToken(context.Background(), idToken, "nonce"); err != nil {
+		t.Errorf("VerifyIDToken: %v", err)
+	}
+}
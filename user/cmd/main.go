@@ -2,17 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"github.com/HJyup/mlt-user/internal/handler"
+	"github.com/HJyup/mlt-user/internal/mailer"
+	"github.com/HJyup/mlt-user/internal/passhash"
 	"github.com/HJyup/mlt-user/internal/service"
 	"github.com/HJyup/mlt-user/internal/store"
-	common "github.com/HJyup/mtl-common"
-	"github.com/HJyup/mtl-common/consul"
-	"github.com/jackc/pgx/v5"
+	"github.com/HJyup/mtl-common"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/app"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/interceptor"
+	"github.com/HJyup/mtl-common/mtls"
+	"github.com/HJyup/mtl-common/tracing"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/kelseyhightower/envconfig"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"net"
+	"log"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -20,90 +29,337 @@ import (
 type Specification struct {
 	ServiceName      string `required:"true" default:"user"`
 	Address          string `required:"true"`
-	Consul           string `required:"true"`
-	Environment      string `required:"true"`
-	PostgresUser     string `required:"true" envconfig:"postgres_user"`
-	PostgresPassword string `required:"true" envconfig:"postgres_password"`
-	PostgresDBName   string `required:"true" envconfig:"postgres_db_name"`
-	PostgresPort     string `required:"true" envconfig:"postgres_port"`
+	Registry         string `default:"consul"`
+	RegistryFile     string `envconfig:"registry_file"`
+	Consul           string
+	Environment      string        `required:"true"`
+	DeregisterDelay  time.Duration `envconfig:"deregister_delay" default:"2s"`
+	DrainTimeout     time.Duration `envconfig:"drain_timeout" default:"15s"`
+	TLSCertFile      string        `envconfig:"tls_cert_file"`
+	TLSKeyFile       string        `envconfig:"tls_key_file"`
+	TLSCAFile        string        `envconfig:"tls_ca_file"`
+	TraceExporter    string        `envconfig:"trace_exporter" default:"none"`
+	TraceEndpoint    string        `envconfig:"trace_endpoint"`
+	TraceInsecure    bool          `envconfig:"trace_insecure"`
+	TraceFile        string        `envconfig:"trace_file"`
+	TraceSampleRatio float64       `envconfig:"trace_sample_ratio" default:"1"`
+	MetricsAddress   string        `envconfig:"metrics_address"`
+	PostgresUser     string        `required:"true" envconfig:"postgres_user"`
+	PostgresPassword string        `required:"true" envconfig:"postgres_password"`
+	PostgresDBName   string        `required:"true" envconfig:"postgres_db_name"`
+	PostgresPort     string        `required:"true" envconfig:"postgres_port"`
+
+	JWTKeysFile       string `envconfig:"jwt_keys_file"`
+	JWTAlgorithm      string `envconfig:"jwt_algorithm" default:"HS256"`
+	JWTSecret         string `envconfig:"jwt_secret"`
+	JWTPrivateKeyFile string `envconfig:"jwt_private_key_file"`
+	JWTKeyID          string `envconfig:"jwt_key_id"`
+
+	AccessTokenTTL  time.Duration `envconfig:"access_token_ttl" default:"15m"`
+	RefreshTokenTTL time.Duration `envconfig:"refresh_token_ttl" default:"720h"`
+
+	ServiceKeysFile string   `envconfig:"service_keys_file"`
+	ServiceSecret   string   `envconfig:"service_secret"`
+	TrustedServices []string `envconfig:"trusted_services"`
+	// ServiceClients are name:secret pairs of services allowed to request
+	// service tokens without an mTLS certificate.
+	ServiceClients map[string]string `envconfig:"service_clients"`
+
+	EmailVerificationURL string        `envconfig:"email_verification_url" default:"http://localhost:3000/verify-email"`
+	EmailVerificationTTL time.Duration `envconfig:"email_verification_ttl" default:"24h"`
+	PasswordResetURL     string        `envconfig:"password_reset_url" default:"http://localhost:3000/reset-password"`
+	PasswordResetTTL     time.Duration `envconfig:"password_reset_ttl" default:"1h"`
+	OutboxInterval       time.Duration `envconfig:"outbox_interval" default:"5s"`
+	// Mailer is smtp, or file or log for local development.
+	Mailer       string `default:"log"`
+	MailFrom     string `envconfig:"mail_from" default:"no-reply@localhost"`
+	MailFile     string `envconfig:"mail_file" default:"mail.log"`
+	SMTPAddr     string `envconfig:"smtp_addr"`
+	SMTPUsername string `envconfig:"smtp_username"`
+	SMTPPassword string `envconfig:"smtp_password"`
+
+	// MFAEncryptionKey is a base64 encoded AES-256 key for TOTP secrets; MFA
+	// enrolment is disabled without it.
+	MFAEncryptionKey string `envconfig:"mfa_encryption_key"`
+	MFAIssuer        string `envconfig:"mfa_issuer"`
+
+	// Password sign-in locks for LoginLockout after LoginMaxFailures failures
+	// against an account, or LoginIPMaxFailures from one IP, doubling with
+	// every further failure up to LoginMaxLockout.
+	LoginMaxFailures   int           `envconfig:"login_max_failures" default:"5"`
+	LoginIPMaxFailures int           `envconfig:"login_ip_max_failures" default:"20"`
+	LoginLockout       time.Duration `envconfig:"login_lockout" default:"1m"`
+	LoginMaxLockout    time.Duration `envconfig:"login_max_lockout" default:"1h"`
+	LoginFailureWindow time.Duration `envconfig:"login_failure_window" default:"24h"`
+
+	// PasswordHasher hashes new passwords, argon2id or bcrypt; hashes made by
+	// the other are still verified, and replaced as users sign in.
+	PasswordHasher    string `envconfig:"password_hasher" default:"argon2id"`
+	Argon2Memory      uint32 `envconfig:"argon2_memory" default:"65536"`
+	Argon2Iterations  uint32 `envconfig:"argon2_iterations" default:"3"`
+	Argon2Parallelism uint8  `envconfig:"argon2_parallelism" default:"4"`
+	BcryptCost        int    `envconfig:"bcrypt_cost" default:"10"`
+	// PasswordHashSlots bounds how many hashes run at once. Zero sizes it
+	// from Argon2Memory and the memory available.
+	PasswordHashSlots int `envconfig:"password_hash_slots"`
+	// PasswordPepper is a server-side secret mixed into argon2id hashes, which
+	// name it by PasswordPepperID. When it changes, the old one goes into
+	// PasswordPreviousPeppers as id:secret, so hashes made with it still verify
+	// and are replaced as users sign in.
+	PasswordPepper          string            `envconfig:"password_pepper"`
+	PasswordPepperID        string            `envconfig:"password_pepper_id"`
+	PasswordPreviousPeppers map[string]string `envconfig:"password_previous_peppers"`
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var s Specification
+	if err := envconfig.Process("user", &s); err != nil {
+		log.Fatalf("Failed to process environment variables: %v", err)
+	}
 
-	logger, err := zap.NewProduction()
+	a, err := app.New(app.Options{
+		ServiceName:     s.ServiceName,
+		Address:         s.Address,
+		Registry:        s.Registry,
+		RegistryFile:    s.RegistryFile,
+		Consul:          s.Consul,
+		DeregisterDelay: s.DeregisterDelay,
+		DrainTimeout:    s.DrainTimeout,
+		MetricsAddress:  s.MetricsAddress,
+		TLS: mtls.Config{
+			CertFile: s.TLSCertFile,
+			KeyFile:  s.TLSKeyFile,
+			CAFile:   s.TLSCAFile,
+		},
+		Tracing: tracing.Config{
+			Environment: s.Environment,
+			Exporter:    s.TraceExporter,
+			Endpoint:    s.TraceEndpoint,
+			Insecure:    s.TraceInsecure,
+			File:        s.TraceFile,
+			SampleRatio: s.TraceSampleRatio,
+		},
+		ServiceKeys: auth.KeyringConfig{
+			KeysFile: s.ServiceKeysFile,
+			Secret:   s.ServiceSecret,
+		},
+	})
 	if err != nil {
-		panic("Failed to create logger: " + err.Error())
+		log.Fatalf("Failed to create app: %v", err)
 	}
-	defer func() {
-		_ = logger.Sync()
-	}()
+	logger := a.Logger()
 
-	var s Specification
-	if err = envconfig.Process("user", &s); err != nil {
-		logger.Fatal("Failed to process environment variables", zap.Error(err))
+	keys, err := auth.NewKeyring(auth.KeyringConfig{
+		KeysFile:       s.JWTKeysFile,
+		Algorithm:      s.JWTAlgorithm,
+		Secret:         s.JWTSecret,
+		PrivateKeyFile: s.JWTPrivateKeyFile,
+		KeyID:          s.JWTKeyID,
+	})
+	if err != nil {
+		logger.Fatal("Failed to load JWT keys", zap.Error(err))
 	}
+	a.Go("jwt keys", func() error {
+		keys.Run(a.Context())
+		return nil
+	})
 
 	dsn := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", s.PostgresUser, s.PostgresPassword, s.PostgresPort, s.PostgresDBName)
 
-	config, err := pgx.ParseConfig(dsn)
+	config, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		logger.Fatal("Failed to parse database config: %v", zap.Error(err))
+		logger.Fatal("Failed to parse database config", zap.Error(err))
 	}
 
-	dbConn, err := pgx.ConnectConfig(ctx, config)
+	dbPool, err := pgxpool.NewWithConfig(a.Context(), config)
 	if err != nil {
-		logger.Fatal("Failed to connect to the database: %v", zap.Error(err))
+		logger.Fatal("Failed to connect to the database", zap.Error(err))
 	}
-	defer func(dbConn *pgx.Conn, ctx context.Context) {
-		err = dbConn.Close(ctx)
-		if err != nil {
-			logger.Fatal("Failed to close database connection: %v", zap.Error(err))
+	a.OnStop("postgres", func(context.Context) error {
+		dbPool.Close()
+		return nil
+	})
+
+	if s.PasswordPepper != "" && !validPepperID(s.PasswordPepperID) {
+		logger.Fatal("Invalid password pepper ID, expected 1 to 32 letters, digits, '-' or '_'")
+	}
+	var previousPeppers []passhash.Pepper
+	for id, secret := range s.PasswordPreviousPeppers {
+		if !validPepperID(id) || id == s.PasswordPepperID {
+			logger.Fatal("Invalid previous password pepper ID", zap.String("id", id))
 		}
-	}(dbConn, ctx)
+		previousPeppers = append(previousPeppers, passhash.Pepper{ID: id, Secret: []byte(secret)})
+	}
+	argon := passhash.NewArgon2id(passhash.Argon2idParams{
+		Memory:      s.Argon2Memory,
+		Iterations:  s.Argon2Iterations,
+		Parallelism: s.Argon2Parallelism,
+	}, passhash.Pepper{ID: s.PasswordPepperID, Secret: []byte(s.PasswordPepper)}, previousPeppers...)
+	bcrypt := passhash.NewBcrypt(s.BcryptCost)
 
-	registry, err := consul.NewRegistry(s.Consul)
-	if err != nil {
-		logger.Fatal("Failed to create registry: %v", zap.Error(err))
-	}
-
-	instanceID := common.GenerateInstanceID(s.ServiceName)
-	if err = registry.Register(instanceID, s.ServiceName, s.Address); err != nil {
-		logger.Fatal("Failed to register service: %v", zap.Error(err))
-	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				if err = registry.HealthCheck(instanceID); err != nil {
-					logger.Error("Failed to health check: %v", zap.Error(err))
-				}
-			}
+	slots := s.PasswordHashSlots
+	if slots == 0 {
+		slots = passhash.Slots(s.Argon2Memory, passhash.AvailableMemory())
+	}
+
+	var hasher *passhash.Hasher
+	switch s.PasswordHasher {
+	case "argon2id":
+		hasher = passhash.NewHasher(slots, argon, bcrypt)
+	case "bcrypt":
+		hasher = passhash.NewHasher(slots, bcrypt, argon)
+	default:
+		logger.Fatal("Unknown password hasher", zap.String("password_hasher", s.PasswordHasher))
+	}
+
+	str := store.NewStore(dbPool, hasher)
+
+	// Revocations are broadcast through the registry when it supports KV.
+	kv, _ := a.Registry().(common.KV)
+
+	// Tokens are checked against the denylist here too, for callers that
+	// reach the service without going through the gateway.
+	denylist := auth.NewDenylist(revokedTokens(str))
+	var revocationChanges <-chan []byte
+	if kv != nil {
+		if revocationChanges, err = kv.WatchKey(a.Context(), auth.RevocationsKey); err != nil {
+			logger.Fatal("Failed to watch token revocations", zap.Error(err))
 		}
-	}()
-	defer registry.DeRegister(instanceID)
+	}
+	a.Go("denylist", func() error {
+		denylist.Run(a.Context(), revocationChanges)
+		return nil
+	})
 
-	grpcServer := grpc.NewServer()
-	conn, err := net.Listen("tcp", s.Address)
-	if err != nil {
-		logger.Fatal("Failed to listen on %s: %v", zap.String("port", s.Address), zap.Error(err))
+	authConfig := interceptor.AuthConfig{
+		Users:           keys,
+		Revocations:     denylist,
+		Services:        a.ServiceIdentity(),
+		TrustedServices: s.TrustedServices,
+		PublicMethods: []string{
+			pb.UserService_CreateUser_FullMethodName,
+			pb.UserService_AuthUser_FullMethodName,
+			pb.UserService_RefreshToken_FullMethodName,
+			// Logout authenticates with the token it revokes.
+			pb.UserService_Logout_FullMethodName,
+			pb.UserService_GetJWKS_FullMethodName,
+			// Revoked token IDs are useless to anyone but a verifier.
+			pb.UserService_ListRevokedTokens_FullMethodName,
+			// Callers authenticate with their certificate or client secret.
+			pb.UserService_IssueServiceToken_FullMethodName,
+			// The personal access token is the credential.
+			pb.UserService_ExchangePersonalAccessToken_FullMethodName,
+			pb.UserService_VerifyEmail_FullMethodName,
+			pb.UserService_ResendVerificationEmail_FullMethodName,
+			pb.UserService_RequestPasswordReset_FullMethodName,
+			pb.UserService_ResetPassword_FullMethodName,
+			// The MFA challenge token is the credential.
+			pb.UserService_VerifyMFA_FullMethodName,
+		},
 	}
-	defer func(conn net.Listener) {
-		err = conn.Close()
-		if err != nil {
-			logger.Warn("Failed to close connection", zap.Error(err))
+	grpcServer := grpc.NewServer(append(a.ServerOptions(),
+		grpc.ChainUnaryInterceptor(interceptor.UnaryServerAuth(authConfig)),
+		grpc.ChainStreamInterceptor(interceptor.StreamServerAuth(authConfig)))...)
+
+	a.Health().AddCheck("postgres", dbPool.Ping)
+	a.Health().Register(grpcServer)
+
+	var mfaKey []byte
+	if s.MFAEncryptionKey != "" {
+		mfaKey, err = base64.StdEncoding.DecodeString(s.MFAEncryptionKey)
+		if err != nil || len(mfaKey) != 32 {
+			logger.Fatal("Invalid MFA encryption key, expected 32 base64 encoded bytes")
 		}
-	}(conn)
+	}
 
-	str := store.NewStore(dbConn)
-	srv := service.NewService(str, logger)
+	srv := service.NewService(str, logger, service.Config{
+		Keys: keys,
+		Tokens: service.TokenConfig{
+			AccessTTL:  s.AccessTokenTTL,
+			RefreshTTL: s.RefreshTokenTTL,
+		},
+		KV: kv,
+		ServiceTokens: service.ServiceTokenConfig{
+			Identity: a.ServiceIdentity(),
+			Clients:  s.ServiceClients,
+		},
+		Email: service.EmailConfig{
+			VerificationURL:  s.EmailVerificationURL,
+			VerificationTTL:  s.EmailVerificationTTL,
+			PasswordResetURL: s.PasswordResetURL,
+			PasswordResetTTL: s.PasswordResetTTL,
+		},
+		MFA: service.MFAConfig{
+			EncryptionKey: mfaKey,
+			Issuer:        s.MFAIssuer,
+		},
+		Login: service.LoginConfig{
+			Account: service.LockoutPolicy{Threshold: s.LoginMaxFailures, BaseDelay: s.LoginLockout, MaxDelay: s.LoginMaxLockout},
+			IP:      service.LockoutPolicy{Threshold: s.LoginIPMaxFailures, BaseDelay: s.LoginLockout, MaxDelay: s.LoginMaxLockout},
+			Window:  s.LoginFailureWindow,
+		},
+	})
 	handler.NewHandler(grpcServer, srv)
 
-	logger.Info("Starting HTTP server", zap.String("port", s.Address))
-	if err = grpcServer.Serve(conn); err != nil {
-		logger.Fatal("Failed to serve gRPC: %v", zap.Error(err))
+	var m mailer.Mailer
+	switch s.Mailer {
+	case "smtp":
+		m = mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Addr:     s.SMTPAddr,
+			Username: s.SMTPUsername,
+			Password: s.SMTPPassword,
+			From:     s.MailFrom,
+		})
+	case "file":
+		m = mailer.NewFileMailer(s.MailFile, s.MailFrom)
+	case "log":
+		m = mailer.NewLogMailer(logger)
+	default:
+		logger.Fatal("Unknown mailer", zap.String("mailer", s.Mailer))
+	}
+	outbox := service.NewOutbox(str, m, logger, s.OutboxInterval)
+	a.Go("outbox", func() error {
+		outbox.Run(a.Context())
+		return nil
+	})
+
+	a.ServeGRPC(grpcServer)
+
+	if err = a.Run(); err != nil {
+		logger.Fatal("Service stopped with error", zap.Error(err))
+	}
+}
+
+// validPepperID reports whether id can be a keyid parameter of a PHC string.
+func validPepperID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// revokedTokens lists revocations straight from the store, as
+// ListRevokedTokens serves them to other verifiers.
+func revokedTokens(str *store.Store) auth.RevocationFetcher {
+	return func(ctx context.Context, since time.Time) ([]auth.Revocation, error) {
+		tokens, err := str.ListRevokedTokens(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+
+		revocations := make([]auth.Revocation, 0, len(tokens))
+		for _, token := range tokens {
+			revocations = append(revocations, auth.Revocation{
+				TokenID:   token.TokenID,
+				ExpiresAt: token.ExpiresAt,
+				RevokedAt: token.RevokedAt,
+			})
+		}
+		return revocations, nil
 	}
 }
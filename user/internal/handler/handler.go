@@ -2,7 +2,10 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"github.com/HJyup/mlt-user/internal/service"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -11,8 +14,33 @@ import (
 type Service interface {
 	CreateUser(ctx context.Context, p *pb.CreateUserRequest) (*pb.CreateUserResponse, error)
 	AuthUser(ctx context.Context, p *pb.AuthUserRequest) (*pb.AuthUserResponse, error)
+	RefreshToken(ctx context.Context, p *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error)
+	Logout(ctx context.Context, p *pb.LogoutRequest) (*pb.LogoutResponse, error)
+	ListRevokedTokens(ctx context.Context, p *pb.ListRevokedTokensRequest) (*pb.ListRevokedTokensResponse, error)
+	ListSessions(ctx context.Context, p *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error)
+	RevokeSession(ctx context.Context, p *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error)
+	RevokeOtherSessions(ctx context.Context, p *pb.RevokeOtherSessionsRequest) (*pb.RevokeOtherSessionsResponse, error)
 	GetUser(ctx context.Context, p *pb.GetUserRequest) (*pb.GetUserResponse, error)
 	DeleteUser(ctx context.Context, p *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error)
+	GetJWKS(ctx context.Context, p *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error)
+	IssueServiceToken(ctx context.Context, p *pb.IssueServiceTokenRequest) (*pb.IssueServiceTokenResponse, error)
+	ListUsers(ctx context.Context, p *pb.ListUsersRequest) (*pb.ListUsersResponse, error)
+	SetUserSuspended(ctx context.Context, p *pb.SetUserSuspendedRequest) (*pb.SetUserSuspendedResponse, error)
+	CreatePersonalAccessToken(ctx context.Context, p *pb.CreatePersonalAccessTokenRequest) (*pb.CreatePersonalAccessTokenResponse, error)
+	ListPersonalAccessTokens(ctx context.Context, p *pb.ListPersonalAccessTokensRequest) (*pb.ListPersonalAccessTokensResponse, error)
+	RevokePersonalAccessToken(ctx context.Context, p *pb.RevokePersonalAccessTokenRequest) (*pb.RevokePersonalAccessTokenResponse, error)
+	ExchangePersonalAccessToken(ctx context.Context, p *pb.ExchangePersonalAccessTokenRequest) (*pb.ExchangePersonalAccessTokenResponse, error)
+	AuthIdentity(ctx context.Context, p *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error)
+	VerifyEmail(ctx context.Context, p *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error)
+	ResendVerificationEmail(ctx context.Context, p *pb.ResendVerificationEmailRequest) (*pb.ResendVerificationEmailResponse, error)
+	ChangePassword(ctx context.Context, p *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error)
+	RequestPasswordReset(ctx context.Context, p *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error)
+	ResetPassword(ctx context.Context, p *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error)
+	EnrollMFA(ctx context.Context, p *pb.EnrollMFARequest) (*pb.EnrollMFAResponse, error)
+	ConfirmMFA(ctx context.Context, p *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error)
+	DisableMFA(ctx context.Context, p *pb.DisableMFARequest) (*pb.DisableMFAResponse, error)
+	VerifyMFA(ctx context.Context, p *pb.VerifyMFARequest) (*pb.AuthUserResponse, error)
+	UnlockUser(ctx context.Context, p *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error)
 }
 
 type Handler struct {
@@ -31,6 +59,12 @@ func NewHandler(grpcServer *grpc.Server, service Service) *Handler {
 func (h *Handler) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
 	resp, err := h.service.CreateUser(ctx, req)
 	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidEmail):
+			return nil, status.Error(codes.InvalidArgument, "invalid email address")
+		case errors.Is(err, service.ErrEmailTaken):
+			return nil, status.Error(codes.AlreadyExists, "user with this email already exists")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
 	}
 	return resp, nil
@@ -39,14 +73,98 @@ func (h *Handler) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*p
 func (h *Handler) AuthUser(ctx context.Context, req *pb.AuthUserRequest) (*pb.AuthUserResponse, error) {
 	resp, err := h.service.AuthUser(ctx, req)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			return nil, status.Error(codes.Unauthenticated, "invalid email or password")
+		}
+		if errors.Is(err, service.ErrLoginLocked) {
+			return nil, status.Error(codes.ResourceExhausted, "too many failed sign-in attempts, try again later")
+		}
+		if errors.Is(err, service.ErrUserSuspended) {
+			return nil, status.Error(codes.PermissionDenied, "account suspended")
+		}
+		if errors.Is(err, service.ErrEmailNotVerified) {
+			return nil, status.Error(codes.FailedPrecondition, "email not verified")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to auth user: %v", err)
 	}
 	return resp, nil
 }
 
+func (h *Handler) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	resp, err := h.service.RefreshToken(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidRefreshToken) || errors.Is(err, service.ErrRefreshTokenReused) || errors.Is(err, service.ErrUserSuspended) {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to refresh token: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	resp, err := h.service.Logout(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to logout: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ListRevokedTokens(ctx context.Context, req *pb.ListRevokedTokensRequest) (*pb.ListRevokedTokensResponse, error) {
+	resp, err := h.service.ListRevokedTokens(ctx, req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list revoked tokens: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	resp, err := h.service.ListSessions(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	resp, err := h.service.RevokeSession(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrSessionNotFound) {
+			return nil, status.Error(codes.NotFound, "session not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) RevokeOtherSessions(ctx context.Context, req *pb.RevokeOtherSessionsRequest) (*pb.RevokeOtherSessionsResponse, error) {
+	resp, err := h.service.RevokeOtherSessions(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revoke other sessions: %v", err)
+	}
+	return resp, nil
+}
+
 func (h *Handler) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
 	resp, err := h.service.GetUser(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
 	}
 	return resp, nil
@@ -55,7 +173,309 @@ func (h *Handler) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetU
 func (h *Handler) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
 	resp, err := h.service.DeleteUser(ctx, req)
 	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to delete user: %v", err)
 	}
 	return resp, nil
 }
+
+func (h *Handler) GetJWKS(ctx context.Context, req *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	resp, err := h.service.GetJWKS(ctx, req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get jwks: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) IssueServiceToken(ctx context.Context, req *pb.IssueServiceTokenRequest) (*pb.IssueServiceTokenResponse, error) {
+	resp, err := h.service.IssueServiceToken(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidServiceClient) {
+			return nil, status.Error(codes.Unauthenticated, "invalid service client")
+		}
+		if errors.Is(err, service.ErrServiceTokensDisabled) {
+			return nil, status.Error(codes.FailedPrecondition, "service tokens are not configured")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to issue service token: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	resp, err := h.service.ListUsers(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list users: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) SetUserSuspended(ctx context.Context, req *pb.SetUserSuspendedRequest) (*pb.SetUserSuspendedResponse, error) {
+	resp, err := h.service.SetUserSuspended(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to set user suspended: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	resp, err := h.service.UnlockUser(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to unlock user: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) CreatePersonalAccessToken(ctx context.Context, req *pb.CreatePersonalAccessTokenRequest) (*pb.CreatePersonalAccessTokenResponse, error) {
+	resp, err := h.service.CreatePersonalAccessToken(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrInvalidScopes) || errors.Is(err, service.ErrEmptyValues) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create personal access token: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ListPersonalAccessTokens(ctx context.Context, req *pb.ListPersonalAccessTokensRequest) (*pb.ListPersonalAccessTokensResponse, error) {
+	resp, err := h.service.ListPersonalAccessTokens(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list personal access tokens: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) RevokePersonalAccessToken(ctx context.Context, req *pb.RevokePersonalAccessTokenRequest) (*pb.RevokePersonalAccessTokenResponse, error) {
+	resp, err := h.service.RevokePersonalAccessToken(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if errors.Is(err, service.ErrPersonalAccessTokenNotFound) {
+			return nil, status.Error(codes.NotFound, "personal access token not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to revoke personal access token: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ExchangePersonalAccessToken(ctx context.Context, req *pb.ExchangePersonalAccessTokenRequest) (*pb.ExchangePersonalAccessTokenResponse, error) {
+	resp, err := h.service.ExchangePersonalAccessToken(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidPersonalAccessToken) || errors.Is(err, service.ErrUserSuspended) {
+			return nil, status.Error(codes.Unauthenticated, "invalid personal access token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to exchange personal access token: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) AuthIdentity(ctx context.Context, req *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error) {
+	resp, err := h.service.AuthIdentity(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		switch {
+		case errors.Is(err, service.ErrEmptyValues):
+			return nil, status.Error(codes.InvalidArgument, "provider, subject and email are required")
+		case errors.Is(err, service.ErrIdentityEmailNotVerified):
+			return nil, status.Error(codes.FailedPrecondition, "email not verified by the identity provider")
+		case errors.Is(err, service.ErrUserSuspended):
+			return nil, status.Error(codes.PermissionDenied, "account suspended")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to auth identity: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	resp, err := h.service.VerifyEmail(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidVerificationToken) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired verification token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to verify email: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ResendVerificationEmail(ctx context.Context, req *pb.ResendVerificationEmailRequest) (*pb.ResendVerificationEmailResponse, error) {
+	resp, err := h.service.ResendVerificationEmail(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrEmptyValues) {
+			return nil, status.Error(codes.InvalidArgument, "email is required")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to resend verification email: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	resp, err := h.service.ChangePassword(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		switch {
+		case errors.Is(err, service.ErrEmptyUserID):
+			return nil, status.Error(codes.InvalidArgument, "user id is required")
+		case errors.Is(err, service.ErrWeakPassword):
+			return nil, status.Errorf(codes.InvalidArgument, "new password must be at least %d characters", service.MinPasswordLength)
+		case errors.Is(err, service.ErrInvalidPassword):
+			return nil, status.Error(codes.PermissionDenied, "current password is incorrect")
+		case errors.Is(err, service.ErrLoginLocked):
+			return nil, status.Error(codes.ResourceExhausted, "too many failed sign-in attempts, try again later")
+		case errors.Is(err, service.ErrUserNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to change password: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	resp, err := h.service.RequestPasswordReset(ctx, req)
+	if err != nil {
+		if errors.Is(err, service.ErrEmptyValues) {
+			return nil, status.Error(codes.InvalidArgument, "email is required")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to request password reset: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	resp, err := h.service.ResetPassword(ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrWeakPassword):
+			return nil, status.Errorf(codes.InvalidArgument, "new password must be at least %d characters", service.MinPasswordLength)
+		case errors.Is(err, service.ErrInvalidPasswordResetToken):
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired password reset token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to reset password: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) EnrollMFA(ctx context.Context, req *pb.EnrollMFARequest) (*pb.EnrollMFAResponse, error) {
+	resp, err := h.service.EnrollMFA(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if mfaErr := mfaStatus(err); mfaErr != nil {
+			return nil, mfaErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to enroll mfa: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) ConfirmMFA(ctx context.Context, req *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error) {
+	resp, err := h.service.ConfirmMFA(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if mfaErr := mfaStatus(err); mfaErr != nil {
+			return nil, mfaErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to confirm mfa: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) DisableMFA(ctx context.Context, req *pb.DisableMFARequest) (*pb.DisableMFAResponse, error) {
+	resp, err := h.service.DisableMFA(ctx, req)
+	if err != nil {
+		if authErr := authStatus(err); authErr != nil {
+			return nil, authErr
+		}
+		if mfaErr := mfaStatus(err); mfaErr != nil {
+			return nil, mfaErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to disable mfa: %v", err)
+	}
+	return resp, nil
+}
+
+func (h *Handler) VerifyMFA(ctx context.Context, req *pb.VerifyMFARequest) (*pb.AuthUserResponse, error) {
+	resp, err := h.service.VerifyMFA(ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidMFAChallenge):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired mfa token")
+		case errors.Is(err, service.ErrInvalidMFACode):
+			return nil, status.Error(codes.InvalidArgument, "invalid mfa code")
+		case errors.Is(err, service.ErrLoginLocked):
+			return nil, status.Error(codes.ResourceExhausted, "too many failed sign-in attempts, try again later")
+		case errors.Is(err, service.ErrUserSuspended):
+			return nil, status.Error(codes.PermissionDenied, "account suspended")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to verify mfa: %v", err)
+	}
+	return resp, nil
+}
+
+// mfaStatus maps the errors shared by the MFA management RPCs to gRPC
+// statuses, or returns nil for any other error.
+func mfaStatus(err error) error {
+	switch {
+	case errors.Is(err, service.ErrEmptyUserID):
+		return status.Error(codes.InvalidArgument, "user id is required")
+	case errors.Is(err, service.ErrInvalidMFACode):
+		return status.Error(codes.InvalidArgument, "invalid mfa code")
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		return status.Error(codes.AlreadyExists, "mfa is already enabled")
+	case errors.Is(err, service.ErrMFANotEnrolled):
+		return status.Error(codes.FailedPrecondition, "mfa is not enrolled")
+	case errors.Is(err, service.ErrMFADisabled):
+		return status.Error(codes.FailedPrecondition, "mfa is not available")
+	case errors.Is(err, service.ErrLoginLocked):
+		return status.Error(codes.ResourceExhausted, "too many failed sign-in attempts, try again later")
+	case errors.Is(err, service.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	default:
+		return nil
+	}
+}
+
+// authStatus maps the service's authorization errors to gRPC statuses, or
+// returns nil for any other error.
+func authStatus(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	case errors.Is(err, auth.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, "permission denied")
+	default:
+		return nil
+	}
+}
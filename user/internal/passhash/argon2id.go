@@ -0,0 +1,204 @@
+package passhash
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// DefaultArgon2idParams are the second recommended option of RFC 9106, for
+// when 2 GiB of memory per hash is too much.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PHC strings encode salts and hashes in unpadded standard base64.
+var phcEncoding = base64.RawStdEncoding
+
+type Argon2idParams struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Argon2id hashes passwords into PHC strings such as
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+//
+// With a pepper, the password is first keyed with HMAC-SHA256, and the hash
+// names the pepper by its ID in the keyid parameter. Hashes made with a
+// previous pepper, or without one, stay verifiable and are outdated.
+type Argon2id struct {
+	params Argon2idParams
+	// keyID names the pepper new hashes use, and peppers holds it along with
+	// the previous ones by ID.
+	keyID   string
+	peppers map[string][]byte
+}
+
+// Pepper is a server-side secret keying argon2id hashes, named by ID.
+type Pepper struct {
+	ID     string
+	Secret []byte
+}
+
+// NewArgon2id returns an Argon2id with params, taking the default for any
+// that are zero. pepper may have no secret, to hash without one; its ID must
+// change whenever the secret does, with the old pepper kept in previous until
+// the hashes made with it are no longer needed.
+func NewArgon2id(params Argon2idParams, pepper Pepper, previous ...Pepper) *Argon2id {
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2idParams.Memory
+	}
+	if params.Iterations == 0 {
+		params.Iterations = DefaultArgon2idParams.Iterations
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = DefaultArgon2idParams.Parallelism
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2idParams.SaltLength
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2idParams.KeyLength
+	}
+
+	a := &Argon2id{params: params, peppers: make(map[string][]byte)}
+	for _, p := range previous {
+		if len(p.Secret) > 0 {
+			a.peppers[p.ID] = p.Secret
+		}
+	}
+	if len(pepper.Secret) > 0 {
+		a.keyID = pepper.ID
+		a.peppers[pepper.ID] = pepper.Secret
+	}
+	return a
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(a.input(password, a.keyID), salt, a.params.Iterations, a.params.Memory, a.params.Parallelism, a.params.KeyLength)
+
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", a.params.Memory, a.params.Iterations, a.params.Parallelism)
+	if a.keyID != "" {
+		params += ",keyid=" + a.keyID
+	}
+	return fmt.Sprintf("%sv=%d$%s$%s$%s", argon2idPrefix, argon2.Version, params,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (a *Argon2id) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (a *Argon2id) Verify(encoded, password string) (bool, bool, error) {
+	h, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	if _, ok := a.peppers[h.keyID]; h.keyID != "" && !ok {
+		return false, false, ErrUnknownKey
+	}
+
+	key := argon2.IDKey(a.input(password, h.keyID), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return false, false, nil
+	}
+
+	outdated := h.memory < a.params.Memory ||
+		h.iterations < a.params.Iterations ||
+		h.parallelism < a.params.Parallelism ||
+		uint32(len(h.salt)) < a.params.SaltLength ||
+		uint32(len(h.key)) < a.params.KeyLength ||
+		h.keyID != a.keyID
+	return true, outdated, nil
+}
+
+// input is what gets hashed for password: the password itself, or its HMAC
+// under the pepper named by keyID for hashes that name one.
+func (a *Argon2id) input(password, keyID string) []byte {
+	if keyID == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, a.peppers[keyID])
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	keyID       string
+	salt        []byte
+	key         []byte
+}
+
+func parseArgon2id(encoded string) (*argon2idHash, error) {
+	// "", "argon2id", "v=19", params, salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, ErrMalformedHash
+	}
+
+	h := &argon2idHash{}
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		var err error
+		switch name {
+		case "m":
+			h.memory, err = parseUint32(value)
+		case "t":
+			h.iterations, err = parseUint32(value)
+		case "p":
+			var p uint64
+			p, err = strconv.ParseUint(value, 10, 8)
+			h.parallelism = uint8(p)
+		case "keyid":
+			h.keyID = value
+		default:
+			err = ErrMalformedHash
+		}
+		if err != nil {
+			return nil, ErrMalformedHash
+		}
+	}
+	if h.memory == 0 || h.iterations == 0 || h.parallelism == 0 {
+		return nil, ErrMalformedHash
+	}
+
+	var err error
+	if h.salt, err = phcEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrMalformedHash
+	}
+	if h.key, err = phcEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrMalformedHash
+	}
+
+	return h, nil
+}
+
+func parseUint32(value string) (uint32, error) {
+	n, err := strconv.ParseUint(value, 10, 32)
+	return uint32(n), err
+}
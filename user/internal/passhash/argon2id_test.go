@@ -0,0 +1,123 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testParams keep hashing fast; the format does not depend on them.
+var testParams = Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestArgon2idVerifiesReferenceHash(t *testing.T) {
+	// From the test vectors of the reference implementation,
+	// github.com/P-H-C/phc-winner-argon2.
+	const encoded = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	a := NewArgon2id(Argon2idParams{Memory: 65536, Iterations: 2, Parallelism: 1}, Pepper{})
+
+	if match, _, err := a.Verify(encoded, "password"); err != nil || !match {
+		t.Fatalf("Verify = %v, %v, want a match", match, err)
+	}
+	if match, _, err := a.Verify(encoded, "Password"); err != nil || match {
+		t.Fatalf("Verify with the wrong password = %v, %v, want no match", match, err)
+	}
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	a := NewArgon2id(testParams, Pepper{})
+
+	encoded, err := a.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hash = %q, want the PHC string of the params", encoded)
+	}
+
+	h, err := parseArgon2id(encoded)
+	if err != nil {
+		t.Fatalf("parseArgon2id: %v", err)
+	}
+	if h.memory != 64 || h.iterations != 1 || h.parallelism != 1 || h.keyID != "" {
+		t.Errorf("parsed params m=%d,t=%d,p=%d,keyid=%q, want m=64,t=1,p=1 and no keyid",
+			h.memory, h.iterations, h.parallelism, h.keyID)
+	}
+	if len(h.salt) != int(DefaultArgon2idParams.SaltLength) || len(h.key) != int(DefaultArgon2idParams.KeyLength) {
+		t.Errorf("parsed %d byte salt and %d byte key, want %d and %d",
+			len(h.salt), len(h.key), DefaultArgon2idParams.SaltLength, DefaultArgon2idParams.KeyLength)
+	}
+
+	match, outdated, err := a.Verify(encoded, "correct horse")
+	if err != nil || !match || outdated {
+		t.Errorf("Verify = %v, %v, %v, want an up to date match", match, outdated, err)
+	}
+	if match, _, err := a.Verify(encoded, "wrong horse"); err != nil || match {
+		t.Errorf("Verify with the wrong password = %v, %v, want no match", match, err)
+	}
+
+	stronger := NewArgon2id(Argon2idParams{Memory: 128, Iterations: 1, Parallelism: 1}, Pepper{})
+	if _, outdated, _ := stronger.Verify(encoded, "correct horse"); !outdated {
+		t.Error("hash with less memory than configured is not outdated")
+	}
+}
+
+func TestParseArgon2idRejectsMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=1$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=256$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1,x=1$c2FsdHNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ=$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+	}
+
+	a := NewArgon2id(testParams, Pepper{})
+	for _, encoded := range tests {
+		if _, _, err := a.Verify(encoded, "password"); !errors.Is(err, ErrMalformedHash) {
+			t.Errorf("Verify(%q) error = %v, want %v", encoded, err, ErrMalformedHash)
+		}
+	}
+}
+
+func TestArgon2idPepperRotation(t *testing.T) {
+	old := Pepper{ID: "2026-01", Secret: []byte("old pepper")}
+	current := Pepper{ID: "2026-10", Secret: []byte("new pepper")}
+
+	before := NewArgon2id(testParams, old)
+	encoded, err := before.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.Contains(encoded, ",keyid=2026-01$") {
+		t.Fatalf("Hash = %q, want the pepper named by keyid", encoded)
+	}
+	unpeppered, err := NewArgon2id(testParams, Pepper{}).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	after := NewArgon2id(testParams, current, old)
+	match, outdated, err := after.Verify(encoded, "correct horse")
+	if err != nil || !match || !outdated {
+		t.Errorf("Verify with the previous pepper = %v, %v, %v, want an outdated match", match, outdated, err)
+	}
+	match, outdated, err = after.Verify(unpeppered, "correct horse")
+	if err != nil || !match || !outdated {
+		t.Errorf("Verify without a pepper = %v, %v, %v, want an outdated match", match, outdated, err)
+	}
+
+	// Without the old pepper the hash cannot be checked at all.
+	if _, _, err := NewArgon2id(testParams, current).Verify(encoded, "correct horse"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Verify without the previous pepper error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	// A different secret under the same ID does not match.
+	replaced := NewArgon2id(testParams, Pepper{ID: old.ID, Secret: []byte("other pepper")})
+	if match, _, err := replaced.Verify(encoded, "correct horse"); err != nil || match {
+		t.Errorf("Verify with another secret = %v, %v, want no match", match, err)
+	}
+}
@@ -0,0 +1,61 @@
+package passhash
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Slots returns how many hashes of memory KiB each fit in half of available
+// bytes, at least one and at most one per CPU. An unknown available, zero,
+// allows one per CPU.
+func Slots(memory uint32, available uint64) int {
+	cpus := runtime.GOMAXPROCS(0)
+	if available == 0 || memory == 0 {
+		return cpus
+	}
+	n := available / 2 / (uint64(memory) * 1024)
+	return int(max(1, min(n, uint64(cpus))))
+}
+
+// AvailableMemory returns the bytes this process may still use: the memory
+// the kernel reports available, capped by the Go memory limit when one is
+// set. It returns zero when neither is known.
+func AvailableMemory() uint64 {
+	available := memAvailable()
+	if limit := debug.SetMemoryLimit(-1); limit > 0 && limit < math.MaxInt64 {
+		if available == 0 || uint64(limit) < available {
+			available = uint64(limit)
+		}
+	}
+	return available
+}
+
+// memAvailable reads MemAvailable from /proc/meminfo, which is only there on
+// Linux.
+func memAvailable() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "MemAvailable:   12345678 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+// Package passhash hashes passwords with a configurable algorithm, and
+// verifies hashes made with earlier ones so that they can be upgraded as users
+// sign in.
+package passhash
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrMalformedHash    = errors.New("malformed password hash")
+	// ErrUnknownKey means the hash was peppered with a key this hasher does
+	// not have, neither the current pepper nor a previous one.
+	ErrUnknownKey = errors.New("password hash uses an unknown pepper")
+)
+
+// Algorithm is one way of hashing passwords.
+type Algorithm interface {
+	Hash(password string) (string, error)
+	// Owns reports whether encoded was made by this algorithm.
+	Owns(encoded string) bool
+	// Verify reports whether password matches encoded, and whether encoded is
+	// outdated, that is weaker than what Hash makes now.
+	Verify(encoded, password string) (match, outdated bool, err error)
+}
+
+// Hasher hashes new passwords with its current algorithm and verifies hashes
+// made by any algorithm it knows.
+//
+// At most slots hashes run at once, since each may hold an argon2id's worth of
+// memory; the rest wait for a slot or for their context to end.
+type Hasher struct {
+	current    Algorithm
+	algorithms []Algorithm
+	slots      chan struct{}
+}
+
+// NewHasher returns a Hasher running at most slots hashes at once, see Slots.
+func NewHasher(slots int, current Algorithm, legacy ...Algorithm) *Hasher {
+	return &Hasher{
+		current:    current,
+		algorithms: append([]Algorithm{current}, legacy...),
+		slots:      make(chan struct{}, max(slots, 1)),
+	}
+}
+
+func (h *Hasher) Hash(ctx context.Context, password string) (string, error) {
+	if err := h.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer h.release()
+
+	return h.current.Hash(password)
+}
+
+// Verify reports whether password matches encoded, and if so whether encoded
+// should be replaced with a new Hash because it was made by another algorithm
+// or is outdated.
+func (h *Hasher) Verify(ctx context.Context, encoded, password string) (match, rehash bool, err error) {
+	if err = h.acquire(ctx); err != nil {
+		return false, false, err
+	}
+	defer h.release()
+
+	for _, algorithm := range h.algorithms {
+		if !algorithm.Owns(encoded) {
+			continue
+		}
+		match, outdated, err := algorithm.Verify(encoded, password)
+		if err != nil || !match {
+			return false, false, err
+		}
+		return true, outdated || algorithm != h.current, nil
+	}
+	return false, false, ErrUnknownAlgorithm
+}
+
+func (h *Hasher) acquire(ctx context.Context) error {
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hasher) release() {
+	<-h.slots
+}
@@ -0,0 +1,87 @@
+package passhash
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasherRehashesLegacyHashes(t *testing.T) {
+	legacy := NewBcrypt(bcrypt.MinCost)
+	h := NewHasher(1, NewArgon2id(testParams, Pepper{}), legacy)
+	ctx := context.Background()
+
+	old, err := legacy.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("bcrypt Hash: %v", err)
+	}
+	match, rehash, err := h.Verify(ctx, old, "correct horse")
+	if err != nil || !match || !rehash {
+		t.Errorf("Verify bcrypt hash = %v, %v, %v, want a match to rehash", match, rehash, err)
+	}
+	if match, rehash, err := h.Verify(ctx, old, "wrong horse"); err != nil || match || rehash {
+		t.Errorf("Verify bcrypt hash with the wrong password = %v, %v, %v, want no match", match, rehash, err)
+	}
+
+	current, err := h.Hash(ctx, "correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	match, rehash, err = h.Verify(ctx, current, "correct horse")
+	if err != nil || !match || rehash {
+		t.Errorf("Verify argon2id hash = %v, %v, %v, want a match to keep", match, rehash, err)
+	}
+
+	if _, _, err := h.Verify(ctx, "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA", "correct horse"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Verify scrypt hash error = %v, want %v", err, ErrUnknownAlgorithm)
+	}
+}
+
+func TestHasherWaitsForSlot(t *testing.T) {
+	h := NewHasher(1, NewArgon2id(testParams, Pepper{}))
+
+	// Hold the only slot, as a hash in progress would.
+	if err := h.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := h.Hash(ctx, "correct horse"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Hash with every slot taken error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	h.release()
+	if _, err := h.Hash(context.Background(), "correct horse"); err != nil {
+		t.Fatalf("Hash after the slot is released: %v", err)
+	}
+}
+
+func TestSlots(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	const gib = 1 << 30
+	tests := []struct {
+		name      string
+		memory    uint32
+		available uint64
+		want      int
+	}{
+		{name: "unknown memory", memory: 64 * 1024, available: 0, want: 4},
+		{name: "bounded by memory", memory: 64 * 1024, available: gib / 4, want: 2},
+		{name: "bounded by cpus", memory: 64 * 1024, available: 16 * gib, want: 4},
+		{name: "at least one", memory: 64 * 1024, available: 1024, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Slots(tt.memory, tt.available); got != tt.want {
+				t.Errorf("Slots(%d, %d) = %d, want %d", tt.memory, tt.available, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/HJyup/mtl-common/auth"
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIP(t *testing.T) {
+	caller := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50123},
+	})
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		reported string
+		want     string
+	}{
+		{
+			name:     "trusted service",
+			ctx:      auth.NewContext(caller, &auth.Principal{Service: "gateway", Trusted: true}),
+			reported: "198.51.100.7",
+			want:     "198.51.100.7",
+		},
+		{
+			name:     "untrusted service",
+			ctx:      auth.NewContext(caller, &auth.Principal{Service: "agent"}),
+			reported: "198.51.100.7",
+			want:     "192.0.2.10",
+		},
+		{
+			name:     "anonymous caller",
+			ctx:      caller,
+			reported: "198.51.100.7",
+			want:     "192.0.2.10",
+		},
+		{
+			name: "anonymous caller omitting the ip",
+			ctx:  caller,
+			want: "192.0.2.10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIP(tt.ctx, tt.reported); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
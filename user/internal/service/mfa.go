@@ -0,0 +1,287 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/HJyup/mlt-user/internal/totp"
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultMFAIssuer = "MTL Agents"
+
+	mfaChallengeTTL = 5 * time.Minute
+	// maxMFAAttempts bounds the codes guessed per challenge; a new challenge
+	// takes the password again.
+	maxMFAAttempts = 5
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollMFA starts TOTP enrolment, returning a new secret for the user's
+// authenticator app. MFA is enabled once ConfirmMFA is called with a code.
+func (svc *Service) EnrollMFA(ctx context.Context, p *pb.EnrollMFARequest) (*pb.EnrollMFAResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+	if svc.mfa.EncryptionKey == nil {
+		return nil, ErrMFADisabled
+	}
+
+	user, err := svc.store.GetUser(ctx, p.GetUserId())
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, fmt.Errorf("create totp secret: %w", err)
+	}
+	encrypted, err := utils.Encrypt(secret, svc.mfa.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt totp secret: %w", err)
+	}
+
+	if err = svc.store.SetPendingTOTP(ctx, user.ID, encrypted); err != nil {
+		return nil, fmt.Errorf("enroll mfa: %w", err)
+	}
+
+	return &pb.EnrollMFAResponse{
+		Secret:     secret,
+		OtpauthUri: totp.URI(svc.mfa.Issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmMFA enables MFA with a first code from the authenticator app, and
+// returns the user's recovery codes. They are not stored and cannot be shown
+// again.
+func (svc *Service) ConfirmMFA(ctx context.Context, p *pb.ConfirmMFARequest) (*pb.ConfirmMFAResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+
+	enrolment, err := svc.store.GetTOTP(ctx, p.GetUserId())
+	if err != nil {
+		return nil, fmt.Errorf("get totp: %w", err)
+	}
+	if enrolment.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, err := svc.checkTOTP(enrolment, p.GetCode())
+	if err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("create recovery codes: %w", err)
+	}
+
+	if err = svc.store.ConfirmTOTP(ctx, p.GetUserId(), step, hashes); err != nil {
+		return nil, fmt.Errorf("confirm mfa: %w", err)
+	}
+
+	svc.log(ctx).Info("mfa enabled", zap.String("user_id", p.GetUserId()))
+
+	return &pb.ConfirmMFAResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableMFA turns MFA off, given a current code or a recovery code.
+func (svc *Service) DisableMFA(ctx context.Context, p *pb.DisableMFARequest) (*pb.DisableMFAResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+
+	user, err := svc.store.GetUser(ctx, p.GetUserId())
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	enrolment, err := svc.store.GetTOTP(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get totp: %w", err)
+	}
+	if enrolment.ConfirmedAt == nil {
+		return nil, ErrMFANotEnrolled
+	}
+
+	// Codes are guessed under the account's sign-in lockout, as in VerifyMFA,
+	// so a stolen session cannot be used to strip MFA by guessing.
+	lockedUntil, err := svc.store.LoginLockedUntil(ctx, user.Email, "")
+	if err != nil {
+		svc.log(ctx).Error("failed to check sign-in lockout", zap.Error(err))
+		return nil, fmt.Errorf("check sign-in lockout: %w", err)
+	}
+	if time.Now().Before(lockedUntil) {
+		return nil, ErrLoginLocked
+	}
+
+	step, recoveryCodeHash, err := svc.checkMFACode(enrolment, p.GetCode())
+	if err == nil {
+		err = svc.store.DisableTOTP(ctx, user.ID, step, recoveryCodeHash)
+	}
+	if errors.Is(err, ErrInvalidMFACode) {
+		svc.recordSignInFailure(ctx, user.Email, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("disable mfa: %w", err)
+	}
+
+	svc.log(ctx).Info("mfa disabled", zap.String("user_id", p.GetUserId()))
+
+	return &pb.DisableMFAResponse{Success: true}, nil
+}
+
+// VerifyMFA completes a sign-in that AuthUser or AuthIdentity answered with an
+// MFA challenge, starting the session with a code or a recovery code.
+func (svc *Service) VerifyMFA(ctx context.Context, p *pb.VerifyMFARequest) (*pb.AuthUserResponse, error) {
+	if p == nil || p.GetMfaToken() == "" {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	challenge, err := svc.store.AttemptMFAChallenge(ctx, hashRefreshToken(p.GetMfaToken()), maxMFAAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("verify mfa: %w", err)
+	}
+
+	// Codes are guessed under the same lockout as passwords, counted against
+	// the account and the IP that opened the challenge, so new challenges do
+	// not buy more guesses.
+	lockedUntil, err := svc.store.LoginLockedUntil(ctx, challenge.Email, challenge.IPAddress)
+	if err != nil {
+		svc.log(ctx).Error("failed to check sign-in lockout", zap.Error(err))
+		return nil, fmt.Errorf("check sign-in lockout: %w", err)
+	}
+	if time.Now().Before(lockedUntil) {
+		signInAttempts.WithLabelValues("locked").Inc()
+		return nil, ErrLoginLocked
+	}
+
+	user, err := svc.completeMFAChallenge(ctx, challenge, p.GetCode())
+	if errors.Is(err, ErrInvalidMFACode) {
+		signInAttempts.WithLabelValues("invalid_mfa").Inc()
+		svc.recordSignInFailure(ctx, challenge.Email, challenge.IPAddress)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("verify mfa: %w", err)
+	}
+
+	signInAttempts.WithLabelValues("success").Inc()
+	svc.clearSignInFailures(ctx, challenge.Email)
+
+	return svc.startSession(ctx, user, challenge.UserAgent, challenge.IPAddress)
+}
+
+// completeMFAChallenge closes the challenge if code answers it, returning the
+// user signing in.
+func (svc *Service) completeMFAChallenge(ctx context.Context, challenge *MFAChallenge, code string) (*User, error) {
+	step, recoveryCodeHash, err := svc.checkMFACode(challenge.TOTP, code)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := svc.store.CompleteMFAChallenge(ctx, challenge.ID, challenge.UserID, step, recoveryCodeHash)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) {
+			svc.log(ctx).Error("failed to complete mfa challenge",
+				zap.String("user_id", challenge.UserID),
+				zap.Error(err))
+		}
+		return nil, err
+	}
+	if recoveryCodeHash != "" {
+		svc.log(ctx).Info("mfa recovery code used", zap.String("user_id", user.ID))
+	}
+
+	return user, nil
+}
+
+// challengeMFA answers a correct password or a verified identity with a
+// challenge for VerifyMFA in place of a token pair.
+func (svc *Service) challengeMFA(ctx context.Context, user *User, userAgent, ipAddress string) (*pb.AuthUserResponse, error) {
+	token, tokenHash, err := newRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("create mfa challenge: %w", err)
+	}
+
+	err = svc.store.CreateMFAChallenge(ctx, user.ID, tokenHash, userAgent, ipAddress, time.Now().Add(mfaChallengeTTL))
+	if err != nil {
+		svc.log(ctx).Error("failed to create mfa challenge",
+			zap.String("user_id", user.ID),
+			zap.Error(err))
+		return nil, fmt.Errorf("create mfa challenge: %w", err)
+	}
+
+	return &pb.AuthUserResponse{
+		Message:     "mfa required",
+		MfaRequired: true,
+		MfaToken:    token,
+	}, nil
+}
+
+// checkMFACode accepts a TOTP code, or failing that a recovery code. It
+// returns the code's time step or the recovery code's hash, for the store to
+// record as used.
+func (svc *Service) checkMFACode(enrolment *TOTP, code string) (int64, string, error) {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) == totp.Digits {
+		step, err := svc.checkTOTP(enrolment, code)
+		return step, "", err
+	}
+	if len(code) != recoveryCodeLength {
+		return 0, "", ErrInvalidMFACode
+	}
+	return 0, hashRefreshToken(code), nil
+}
+
+// checkTOTP returns the time step of a valid code that is newer than the last
+// one used.
+func (svc *Service) checkTOTP(enrolment *TOTP, code string) (int64, error) {
+	secret, err := utils.Decrypt(enrolment.Secret, svc.mfa.EncryptionKey)
+	if err != nil {
+		return 0, fmt.Errorf("decrypt totp secret: %w", err)
+	}
+
+	step, ok := totp.Validate(secret, strings.TrimSpace(code), time.Now())
+	if !ok || step <= enrolment.LastUsedStep {
+		return 0, ErrInvalidMFACode
+	}
+	return step, nil
+}
+
+// newRecoveryCodes returns codes formatted for the user, such as
+// "abcde-fghij", and the hashes stored in their place.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, recoveryCodeLength*5/8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashRefreshToken(code))
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/HJyup/mtl-common/api"
+)
+
+func TestDisableMFALocksOutGuessing(t *testing.T) {
+	store := newFakeStore()
+	confirmedAt := time.Now()
+	store.totp = &TOTP{ConfirmedAt: &confirmedAt}
+	store.recoveryCodes[hashRefreshToken("abcdefghij")] = true
+
+	svc := newTestService(store)
+	ctx := userContext(store.user)
+
+	for i := range DefaultAccountLockout.Threshold {
+		_, err := svc.DisableMFA(ctx, &pb.DisableMFARequest{UserId: store.user.ID, Code: "zzzzz-zzzzz"})
+		if !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("guess %d: error = %v, want %v", i+1, err, ErrInvalidMFACode)
+		}
+	}
+
+	// Even a valid recovery code is refused while the account is locked.
+	_, err := svc.DisableMFA(ctx, &pb.DisableMFARequest{UserId: store.user.ID, Code: "abcde-fghij"})
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("error = %v, want %v", err, ErrLoginLocked)
+	}
+	if store.totp == nil {
+		t.Error("mfa disabled during the lockout")
+	}
+
+	// Once the lockout is lifted the code works again.
+	if err = store.ClearLoginFailures(ctx, store.user.Email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.DisableMFA(ctx, &pb.DisableMFARequest{UserId: store.user.ID, Code: "abcde-fghij"}); err != nil {
+		t.Fatalf("DisableMFA: %v", err)
+	}
+	if store.totp != nil {
+		t.Error("mfa still enabled")
+	}
+}
@@ -1,8 +1,84 @@
 package service
 
+import "time"
+
 type User struct {
-	ID       string
-	Username string
-	Email    string
-	Password string
+	ID          string
+	Username    string
+	Email       string
+	Password    string
+	Roles       []string
+	CreatedAt   time.Time
+	SuspendedAt *time.Time
+	// MFAEnabled is only set by AuthUser.
+	MFAEnabled bool
+}
+
+type RevokedToken struct {
+	TokenID   string
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+type Session struct {
+	ID         string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+type PersonalAccessToken struct {
+	ID         string
+	UserID     string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// Identity is a user's identity at an external OpenID Connect provider, as
+// asserted by the provider.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// EmailToken is a single-use token, such as an email verification or password
+// reset token, stored with the message that delivers it.
+type EmailToken struct {
+	TokenHash string
+	ExpiresAt time.Time
+	Message   *OutboxMessage
+}
+
+// TOTP is a user's TOTP enrolment, confirmed once ConfirmedAt is set. Secret
+// is encrypted.
+type TOTP struct {
+	Secret       string
+	LastUsedStep int64
+	ConfirmedAt  *time.Time
+}
+
+// MFAChallenge is a pending password sign-in awaiting a second factor.
+type MFAChallenge struct {
+	ID     string
+	UserID string
+	// Email is the account that wrong codes are counted against.
+	Email     string
+	UserAgent string
+	IPAddress string
+	TOTP      *TOTP
+}
+
+type OutboxMessage struct {
+	ID       int64
+	To       string
+	Subject  string
+	Body     string
+	Attempts int
 }
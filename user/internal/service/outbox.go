@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/HJyup/mlt-user/internal/mailer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultOutboxInterval = 5 * time.Second
+
+	outboxBatchSize = 20
+	// outboxLease is how long a claimed message is hidden from other senders.
+	// It must outlast a send.
+	outboxLease       = time.Minute
+	outboxSendTimeout = 30 * time.Second
+	outboxMaxAttempts = 10
+	outboxMaxBackoff  = time.Hour
+)
+
+var outboxMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "user_outbox_messages_total",
+	Help: "Outbox emails handed to the mailer, by result.",
+}, []string{"result"})
+
+type OutboxStore interface {
+	// ClaimOutboxMessages returns due messages that have attempts left,
+	// counting an attempt and leasing them for lease.
+	ClaimOutboxMessages(ctx context.Context, limit, maxAttempts int, lease time.Duration) ([]*OutboxMessage, error)
+	MarkOutboxMessageSent(ctx context.Context, id int64) error
+	MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, nextAttemptAt time.Time) error
+}
+
+// Outbox sends the emails the store queued alongside the changes they belong
+// to, so an email is only sent once its change is committed and is retried
+// until the mailer accepts it. Delivery is at least once.
+type Outbox struct {
+	store    OutboxStore
+	mailer   mailer.Mailer
+	logger   *zap.Logger
+	interval time.Duration
+}
+
+func NewOutbox(store OutboxStore, mailer mailer.Mailer, logger *zap.Logger, interval time.Duration) *Outbox {
+	if interval <= 0 {
+		interval = DefaultOutboxInterval
+	}
+	return &Outbox{store: store, mailer: mailer, logger: logger, interval: interval}
+}
+
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		// A full batch suggests more are waiting.
+		for {
+			sent, err := o.dispatch(ctx)
+			if err != nil {
+				o.logger.Warn("failed to dispatch outbox", zap.Error(err))
+			}
+			if err != nil || sent < outboxBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) dispatch(ctx context.Context) (int, error) {
+	messages, err := o.store.ClaimOutboxMessages(ctx, outboxBatchSize, outboxMaxAttempts, outboxLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range messages {
+		sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+		err = o.mailer.Send(sendCtx, &mailer.Message{To: msg.To, Subject: msg.Subject, Body: msg.Body})
+		cancel()
+
+		if err != nil {
+			outboxMessages.WithLabelValues("failed").Inc()
+			o.logger.Warn("failed to send email",
+				zap.Int64("message_id", msg.ID),
+				zap.Int("attempt", msg.Attempts),
+				zap.Error(err))
+			if err = o.store.MarkOutboxMessageFailed(ctx, msg.ID, err.Error(), time.Now().Add(outboxBackoff(msg.Attempts))); err != nil {
+				o.logger.Warn("failed to reschedule email", zap.Int64("message_id", msg.ID), zap.Error(err))
+			}
+			continue
+		}
+
+		outboxMessages.WithLabelValues("sent").Inc()
+		if err = o.store.MarkOutboxMessageSent(ctx, msg.ID); err != nil {
+			o.logger.Warn("failed to mark email sent", zap.Int64("message_id", msg.ID), zap.Error(err))
+		}
+	}
+
+	return len(messages), nil
+}
+
+// outboxBackoff doubles from 30 seconds with each attempt, up to an hour.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 7 {
+		return outboxMaxBackoff
+	}
+	return min(30*time.Second<<attempts, outboxMaxBackoff)
+}
@@ -2,42 +2,283 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/HJyup/mtl-common"
 	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
+	"github.com/HJyup/mtl-common/logging"
+	"github.com/HJyup/mtl-common/mtls"
 	"github.com/HJyup/mtl-common/utils"
 	"go.uber.org/zap"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	ErrEmptyValues = errors.New("empty values")
 	ErrEmptyUserID = errors.New("user id is empty")
+
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUserSuspended       = errors.New("user is suspended")
+
+	ErrServiceTokensDisabled = errors.New("service tokens are not configured")
+	ErrInvalidServiceClient  = errors.New("invalid service client")
+
+	ErrInvalidScopes               = errors.New("invalid scopes")
+	ErrPersonalAccessTokenNotFound = errors.New("personal access token not found")
+	ErrInvalidPersonalAccessToken  = errors.New("invalid personal access token")
+
+	ErrIdentityEmailNotVerified = errors.New("email is not verified by the identity provider")
+
+	ErrInvalidEmail             = errors.New("invalid email address")
+	ErrEmailTaken               = errors.New("user with this email already exists")
+	ErrEmailNotVerified         = errors.New("email is not verified")
+	ErrInvalidVerificationToken = errors.New("invalid verification token")
+	ErrVerificationTooSoon      = errors.New("verification email sent too recently")
+
+	ErrInvalidPassword           = errors.New("invalid password")
+	ErrWeakPassword              = errors.New("password is too short")
+	ErrInvalidPasswordResetToken = errors.New("invalid password reset token")
+	ErrPasswordResetTooSoon      = errors.New("password reset email sent too recently")
+
+	ErrMFADisabled         = errors.New("mfa is not configured")
+	ErrMFAAlreadyEnabled   = errors.New("mfa is already enabled")
+	ErrMFANotEnrolled      = errors.New("mfa is not enrolled")
+	ErrInvalidMFAChallenge = errors.New("invalid mfa challenge")
+	ErrInvalidMFACode      = errors.New("invalid mfa code")
+
+	// ErrInvalidCredentials is returned alike for unknown emails and wrong
+	// passwords.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrLoginLocked        = errors.New("too many failed sign-in attempts")
 )
 
 type Store interface {
-	CreateUser(ctx context.Context, username, email, password string) (string, error)
+	// CreateUser stores the user together with their email verification, whose
+	// message is sent through the outbox once committed. It returns
+	// ErrEmailTaken if a user already has the email.
+	CreateUser(ctx context.Context, username, email, password string, verification *EmailToken) (string, error)
+	CreateEmailVerification(ctx context.Context, email string, verification *EmailToken, notSince time.Time) error
+	// VerifyEmail uses up a verification token and returns its user's ID.
+	VerifyEmail(ctx context.Context, tokenHash string) (string, error)
+	// AuthUser returns ErrInvalidCredentials for an unknown email or a wrong
+	// password, taking as long either way.
 	AuthUser(ctx context.Context, email, password string) (*User, error)
+	// LoginLockedUntil returns when the later of the account and IP lockouts
+	// ends, or the zero time if neither is locked.
+	LoginLockedUntil(ctx context.Context, email, ipAddress string) (time.Time, error)
+	// RecordLoginFailure counts a failure against the account and IP, locking
+	// them as config says, and returns LoginLockedUntil.
+	RecordLoginFailure(ctx context.Context, email, ipAddress string, config LoginConfig) (time.Time, error)
+	ClearLoginFailures(ctx context.Context, email string) error
+	UnlockUser(ctx context.Context, userID string) error
 	GetUser(ctx context.Context, id string) (*User, error)
-	DeleteUser(ctx context.Context, id string) error
+	// DeleteUser denies the user's sessions and the access tokens exchanged for
+	// their personal access tokens until deniedUntil, then deletes the user.
+	DeleteUser(ctx context.Context, id string, deniedUntil time.Time) error
+	CreateSession(ctx context.Context, userID, userAgent, ipAddress string) (string, error)
+	ListSessions(ctx context.Context, userID string, seenSince time.Time) ([]*Session, error)
+	// RevokeSession and RevokeOtherSessions also revoke the sessions' refresh
+	// tokens and deny their IDs until deniedUntil, when the last access token
+	// issued for them has expired.
+	RevokeSession(ctx context.Context, userID, sessionID string, deniedUntil time.Time) error
+	RevokeOtherSessions(ctx context.Context, userID, keepSessionID string, deniedUntil time.Time) (int64, error)
+	ListUsers(ctx context.Context, limit, offset int) ([]*User, error)
+	// SetUserSuspended revokes all of the user's sessions when suspending.
+	SetUserSuspended(ctx context.Context, userID string, suspended bool, deniedUntil time.Time) error
+	CreateRefreshToken(ctx context.Context, userID, sessionID, tokenHash string, expiresAt time.Time) error
+	// RotateRefreshToken marks the token rotated and stores its replacement in
+	// the same family, returning the user and session it belongs to. Presenting
+	// an already rotated token revokes the family and returns ErrRefreshTokenReused.
+	RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*User, string, error)
+	// RevokeRefreshTokenFamily revokes the family of the user's refresh token,
+	// and does nothing if the token belongs to someone else.
+	RevokeRefreshTokenFamily(ctx context.Context, userID, tokenHash string) error
+	RevokeToken(ctx context.Context, tokenID, userID string, expiresAt time.Time) error
+	ListRevokedTokens(ctx context.Context, since time.Time) ([]*RevokedToken, error)
+	CreatePersonalAccessToken(ctx context.Context, userID, name, tokenHash string, scopes []string, expiresAt time.Time) (string, error)
+	ListPersonalAccessTokens(ctx context.Context, userID string) ([]*PersonalAccessToken, error)
+	// RevokePersonalAccessToken also denies the token's ID until deniedUntil,
+	// which the access tokens exchanged for it carry as their sid.
+	RevokePersonalAccessToken(ctx context.Context, userID, tokenID string, deniedUntil time.Time) error
+	// UsePersonalAccessToken returns an active token and its owner, recording
+	// the use.
+	UsePersonalAccessToken(ctx context.Context, tokenHash string) (*PersonalAccessToken, *User, error)
+	// AuthIdentity returns the user an external identity belongs to, linking
+	// or creating one, and whether the user was created.
+	AuthIdentity(ctx context.Context, identity *Identity) (*User, bool, error)
+	// ChangePassword returns ErrInvalidPassword unless currentPassword matches,
+	// and revokes every session but keepSessionID.
+	ChangePassword(ctx context.Context, userID, currentPassword, newPassword, keepSessionID string, deniedUntil time.Time) (int64, error)
+	CreatePasswordReset(ctx context.Context, email string, reset *EmailToken, notSince time.Time) error
+	// ResetPassword uses up a reset token, sets its user's password and revokes
+	// all of the user's sessions, returning the user's ID.
+	ResetPassword(ctx context.Context, tokenHash, newPassword string, deniedUntil time.Time) (string, error)
+	// SetPendingTOTP returns ErrMFAAlreadyEnabled if the user has a confirmed
+	// secret.
+	SetPendingTOTP(ctx context.Context, userID, secret string) error
+	GetTOTP(ctx context.Context, userID string) (*TOTP, error)
+	ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error
+	// DisableTOTP and CompleteMFAChallenge use up the recovery code if
+	// recoveryCodeHash is set, and otherwise record step as the last TOTP step
+	// used. Either returns ErrInvalidMFACode if it was used before.
+	DisableTOTP(ctx context.Context, userID string, step int64, recoveryCodeHash string) error
+	CreateMFAChallenge(ctx context.Context, userID, tokenHash, userAgent, ipAddress string, expiresAt time.Time) error
+	AttemptMFAChallenge(ctx context.Context, tokenHash string, maxAttempts int) (*MFAChallenge, error)
+	CompleteMFAChallenge(ctx context.Context, challengeID, userID string, step int64, recoveryCodeHash string) (*User, error)
+}
+
+const (
+	maxListUsersLimit = 200
+
+	DefaultEmailVerificationTTL = 24 * time.Hour
+	// verificationResendInterval stops ResendVerificationEmail from being used
+	// to flood an inbox.
+	verificationResendInterval = time.Minute
+
+	DefaultPasswordResetTTL = time.Hour
+	// passwordResetInterval stops RequestPasswordReset from being used to
+	// flood an inbox.
+	passwordResetInterval = time.Minute
+	// MinPasswordLength applies to new passwords; existing ones are not
+	// rejected at sign-in.
+	MinPasswordLength = 8
+
+	defaultPersonalAccessTokenTTL = 30 * 24 * time.Hour
+	maxPersonalAccessTokenTTL     = 365 * 24 * time.Hour
+)
+
+type TokenConfig struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// ServiceTokenConfig lets services that do not hold the shared service keys,
+// such as the agent, obtain service tokens.
+type ServiceTokenConfig struct {
+	// Identity signs the issued tokens; nil disables IssueServiceToken.
+	Identity *auth.ServiceIdentity
+	// Clients maps service names to secrets, for callers that cannot prove
+	// their name with an mTLS certificate.
+	Clients map[string]string
+}
+
+type EmailConfig struct {
+	// VerificationURL is the page that confirms an email; the token is added
+	// as its token query parameter.
+	VerificationURL string
+	VerificationTTL time.Duration
+	// PasswordResetURL is the page that sets a new password, likewise given
+	// the token as its token query parameter.
+	PasswordResetURL string
+	PasswordResetTTL time.Duration
+}
+
+type MFAConfig struct {
+	// EncryptionKey is the AES-256 key TOTP secrets are stored under; nil
+	// disables enrolment.
+	EncryptionKey []byte
+	// Issuer names the service in authenticator apps.
+	Issuer string
 }
 
 type Service struct {
 	store  Store
 	logger *zap.Logger
+	keys   *auth.Keyring
+	tokens TokenConfig
+	// kv broadcasts revocations to verifiers; nil if the registry has no KV.
+	kv            common.KV
+	serviceTokens ServiceTokenConfig
+	email         EmailConfig
+	mfa           MFAConfig
+	login         LoginConfig
+}
+
+// Config is what the Service needs besides its store and logger.
+type Config struct {
+	// Keys sign user tokens.
+	Keys   *auth.Keyring
+	Tokens TokenConfig
+	// KV broadcasts revocations to verifiers; nil if the registry has no KV.
+	KV            common.KV
+	ServiceTokens ServiceTokenConfig
+	Email         EmailConfig
+	MFA           MFAConfig
+	Login         LoginConfig
 }
 
-func NewService(store Store, logger *zap.Logger) *Service {
-	return &Service{store: store, logger: logger}
+func NewService(store Store, logger *zap.Logger, config Config) *Service {
+	email, mfa, login := config.Email, config.MFA, config.Login
+	if email.VerificationTTL <= 0 {
+		email.VerificationTTL = DefaultEmailVerificationTTL
+	}
+	if email.PasswordResetTTL <= 0 {
+		email.PasswordResetTTL = DefaultPasswordResetTTL
+	}
+	if mfa.Issuer == "" {
+		mfa.Issuer = DefaultMFAIssuer
+	}
+	if login.Account == (LockoutPolicy{}) {
+		login.Account = DefaultAccountLockout
+	}
+	if login.IP == (LockoutPolicy{}) {
+		login.IP = DefaultIPLockout
+	}
+	if login.Window <= 0 {
+		login.Window = DefaultLoginFailureWindow
+	}
+	return &Service{
+		store:         store,
+		logger:        logger,
+		keys:          config.Keys,
+		tokens:        config.Tokens,
+		kv:            config.KV,
+		serviceTokens: config.ServiceTokens,
+		email:         email,
+		mfa:           mfa,
+		login:         login,
+	}
+}
+
+// log returns the request-scoped logger set by the server interceptors, which
+// carries the caller's request ID.
+func (svc *Service) log(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, svc.logger)
 }
 
 func (svc *Service) CreateUser(ctx context.Context, p *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
 	if p == nil || p.GetUsername() == "" || p.GetEmail() == "" || p.GetPassword() == "" {
 		return nil, ErrEmptyValues
 	}
+	if address, err := mail.ParseAddress(p.GetEmail()); err != nil || address.Address != p.GetEmail() {
+		return nil, ErrInvalidEmail
+	}
 
-	userID, err := svc.store.CreateUser(ctx, p.Username, p.Email, p.Password)
+	verification, err := svc.newEmailVerification(p.GetEmail())
 	if err != nil {
-		svc.logger.Error("failed to create user",
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+
+	userID, err := svc.store.CreateUser(ctx, p.Username, p.Email, p.Password, verification)
+	if errors.Is(err, ErrEmailTaken) {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	if err != nil {
+		svc.log(ctx).Error("failed to create user",
 			zap.String("username", p.Username),
 			zap.String("email", p.Email),
 			zap.Error(err))
@@ -49,40 +290,535 @@ func (svc *Service) CreateUser(ctx context.Context, p *pb.CreateUserRequest) (*p
 	}, nil
 }
 
+func (svc *Service) VerifyEmail(ctx context.Context, p *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	if p == nil || p.GetToken() == "" {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	userID, err := svc.store.VerifyEmail(ctx, hashRefreshToken(p.GetToken()))
+	if err != nil {
+		return nil, fmt.Errorf("verify email: %w", err)
+	}
+
+	svc.log(ctx).Info("email verified", zap.String("user_id", userID))
+
+	return &pb.VerifyEmailResponse{Success: true}, nil
+}
+
+// ResendVerificationEmail sends a new verification email to an unverified
+// user. It succeeds whether or not there is one, so it cannot be used to find
+// out which emails are registered.
+func (svc *Service) ResendVerificationEmail(ctx context.Context, p *pb.ResendVerificationEmailRequest) (*pb.ResendVerificationEmailResponse, error) {
+	if p == nil || p.GetEmail() == "" {
+		return nil, ErrEmptyValues
+	}
+
+	verification, err := svc.newEmailVerification(p.GetEmail())
+	if err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+
+	err = svc.store.CreateEmailVerification(ctx, p.GetEmail(), verification, time.Now().Add(-verificationResendInterval))
+	if err != nil && !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrVerificationTooSoon) {
+		svc.log(ctx).Error("failed to resend verification email", zap.Error(err))
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+
+	return &pb.ResendVerificationEmailResponse{Success: true}, nil
+}
+
+// ChangePassword sets a new password for a user who knows the current one,
+// signing out every other session.
+func (svc *Service) ChangePassword(ctx context.Context, p *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+	if p.GetCurrentPassword() == "" {
+		return nil, ErrInvalidPassword
+	}
+	if len(p.GetNewPassword()) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	user, err := svc.store.GetUser(ctx, p.GetUserId())
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	// The current password is guessed under the account's sign-in lockout,
+	// so a stolen session cannot be used to guess it faster.
+	lockedUntil, err := svc.store.LoginLockedUntil(ctx, user.Email, "")
+	if err != nil {
+		svc.log(ctx).Error("failed to check sign-in lockout", zap.Error(err))
+		return nil, fmt.Errorf("check sign-in lockout: %w", err)
+	}
+	if time.Now().Before(lockedUntil) {
+		return nil, ErrLoginLocked
+	}
+
+	// A trusted service changing the password on the user's behalf has no
+	// session to keep.
+	keepSessionID := auth.FromContext(ctx).SessionID
+
+	revoked, err := svc.store.ChangePassword(ctx, p.GetUserId(), p.GetCurrentPassword(), p.GetNewPassword(),
+		keepSessionID, time.Now().Add(svc.tokens.AccessTTL))
+	if errors.Is(err, ErrInvalidPassword) {
+		svc.recordSignInFailure(ctx, user.Email, "")
+	}
+	if err != nil {
+		if !errors.Is(err, ErrInvalidPassword) {
+			svc.log(ctx).Error("failed to change password",
+				zap.String("user_id", p.GetUserId()),
+				zap.Error(err))
+		}
+		return nil, fmt.Errorf("change password: %w", err)
+	}
+
+	if revoked > 0 {
+		svc.notifyRevocation(ctx)
+	}
+
+	svc.log(ctx).Info("password changed",
+		zap.String("user_id", p.GetUserId()),
+		zap.Int64("revoked_sessions", revoked))
+
+	return &pb.ChangePasswordResponse{Revoked: revoked}, nil
+}
+
+// RequestPasswordReset emails a password reset link to the user with the
+// given email. Like ResendVerificationEmail, it succeeds whether or not there
+// is one.
+func (svc *Service) RequestPasswordReset(ctx context.Context, p *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	if p == nil || p.GetEmail() == "" {
+		return nil, ErrEmptyValues
+	}
+
+	reset, err := svc.newPasswordReset(p.GetEmail())
+	if err != nil {
+		return nil, fmt.Errorf("create password reset: %w", err)
+	}
+
+	err = svc.store.CreatePasswordReset(ctx, p.GetEmail(), reset, time.Now().Add(-passwordResetInterval))
+	if err != nil && !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrPasswordResetTooSoon) {
+		svc.log(ctx).Error("failed to request password reset", zap.Error(err))
+		return nil, fmt.Errorf("create password reset: %w", err)
+	}
+
+	return &pb.RequestPasswordResetResponse{Success: true}, nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset,
+// signing out all of the user's sessions.
+func (svc *Service) ResetPassword(ctx context.Context, p *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	if p == nil || p.GetToken() == "" {
+		return nil, ErrInvalidPasswordResetToken
+	}
+	if len(p.GetNewPassword()) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	userID, err := svc.store.ResetPassword(ctx, hashRefreshToken(p.GetToken()), p.GetNewPassword(),
+		time.Now().Add(svc.tokens.AccessTTL))
+	if err != nil {
+		return nil, fmt.Errorf("reset password: %w", err)
+	}
+
+	svc.notifyRevocation(ctx)
+
+	svc.log(ctx).Info("password reset", zap.String("user_id", userID))
+
+	return &pb.ResetPasswordResponse{Success: true}, nil
+}
+
+func (svc *Service) newEmailVerification(email string) (*EmailToken, error) {
+	return newEmailToken(email, svc.email.VerificationURL, svc.email.VerificationTTL,
+		"Confirm your email address",
+		"Confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not sign up, you can ignore this email.\n")
+}
+
+func (svc *Service) newPasswordReset(email string) (*EmailToken, error) {
+	return newEmailToken(email, svc.email.PasswordResetURL, svc.email.PasswordResetTTL,
+		"Reset your password",
+		"Choose a new password by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask to reset your password, you can ignore this email.\n")
+}
+
+// newEmailToken creates a token and the email to deliver it, linking to page
+// with the token as its token query parameter. body is formatted with the
+// link and the token's lifetime.
+func newEmailToken(email, page string, ttl time.Duration, subject, body string) (*EmailToken, error) {
+	token, tokenHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := url.Parse(page)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return &EmailToken{
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(ttl),
+		Message: &OutboxMessage{
+			To:      email,
+			Subject: subject,
+			Body:    fmt.Sprintf(body, link, ttl),
+		},
+	}, nil
+}
+
 func (svc *Service) AuthUser(ctx context.Context, p *pb.AuthUserRequest) (*pb.AuthUserResponse, error) {
 	if p == nil || p.GetEmail() == "" || p.GetPassword() == "" {
 		return nil, ErrEmptyValues
 	}
+	ipAddress := clientIP(ctx, p.GetIpAddress())
+
+	// A locked sign-in is refused without checking the password, so guesses
+	// made during the lockout tell nothing.
+	lockedUntil, err := svc.store.LoginLockedUntil(ctx, p.GetEmail(), ipAddress)
+	if err != nil {
+		svc.log(ctx).Error("failed to check sign-in lockout", zap.Error(err))
+		return nil, fmt.Errorf("check sign-in lockout: %w", err)
+	}
+	if time.Now().Before(lockedUntil) {
+		signInAttempts.WithLabelValues("locked").Inc()
+		return nil, ErrLoginLocked
+	}
 
 	user, err := svc.store.AuthUser(ctx, p.Email, p.Password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		signInAttempts.WithLabelValues("invalid").Inc()
+		svc.recordSignInFailure(ctx, p.GetEmail(), ipAddress)
+		return nil, fmt.Errorf("authenticate user: %w", err)
+	}
 	if err != nil {
-		svc.logger.Error("failed to auth user",
+		svc.log(ctx).Error("failed to auth user",
 			zap.String("email", p.Email),
 			zap.Error(err))
 		return nil, fmt.Errorf("authenticate user: %w", err)
 	}
 
-	token, err := utils.CreateToken(user.ID, p.Email, user.Username)
+	// Failures are cleared only once the sign-in is complete, so wrong MFA
+	// codes keep counting against the account across new challenges.
+	if user.MFAEnabled {
+		signInAttempts.WithLabelValues("mfa_required").Inc()
+		return svc.challengeMFA(ctx, user, p.GetUserAgent(), ipAddress)
+	}
+
+	signInAttempts.WithLabelValues("success").Inc()
+	svc.clearSignInFailures(ctx, p.GetEmail())
+
+	return svc.startSession(ctx, user, p.GetUserAgent(), ipAddress)
+}
+
+// AuthIdentity signs in a user authenticated by an external identity provider.
+// The gateway runs the OpenID Connect flow and verifies the ID token, so only
+// trusted services may vouch for an identity.
+func (svc *Service) AuthIdentity(ctx context.Context, p *pb.AuthIdentityRequest) (*pb.AuthIdentityResponse, error) {
+	if err := auth.AuthorizeTrustedService(ctx); err != nil {
+		return nil, err
+	}
+	if p == nil || p.GetProvider() == "" || p.GetSubject() == "" || p.GetEmail() == "" {
+		return nil, ErrEmptyValues
+	}
+
+	username := p.GetUsername()
+	if username == "" {
+		username, _, _ = strings.Cut(p.GetEmail(), "@")
+	}
+
+	user, created, err := svc.store.AuthIdentity(ctx, &Identity{
+		Provider:      p.GetProvider(),
+		Subject:       p.GetSubject(),
+		Email:         p.GetEmail(),
+		EmailVerified: p.GetEmailVerified(),
+		Username:      username,
+	})
+	if err != nil {
+		svc.log(ctx).Warn("failed to auth identity",
+			zap.String("provider", p.GetProvider()),
+			zap.String("email", p.GetEmail()),
+			zap.Error(err))
+		return nil, fmt.Errorf("authenticate identity: %w", err)
+	}
+	if created {
+		svc.log(ctx).Info("user created from identity",
+			zap.String("user_id", user.ID),
+			zap.String("provider", p.GetProvider()))
+	}
+
+	// Identities are linked by email, so the provider vouches for the email
+	// address only and the second factor is still required.
+	if user.MFAEnabled {
+		challenge, err := svc.challengeMFA(ctx, user, p.GetUserAgent(), p.GetIpAddress())
+		if err != nil {
+			return nil, err
+		}
+		return &pb.AuthIdentityResponse{
+			MfaRequired: challenge.MfaRequired,
+			MfaToken:    challenge.MfaToken,
+		}, nil
+	}
+
+	resp, err := svc.startSession(ctx, user, p.GetUserAgent(), p.GetIpAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.AuthIdentityResponse{
+		Token:        resp.Token,
+		RefreshToken: resp.RefreshToken,
+		ExpiresIn:    resp.ExpiresIn,
+		UserId:       user.ID,
+		Created:      created,
+	}, nil
+}
+
+// startSession creates a session for an authenticated user and issues its
+// first token pair.
+func (svc *Service) startSession(ctx context.Context, user *User, userAgent, ipAddress string) (*pb.AuthUserResponse, error) {
+	sessionID, err := svc.store.CreateSession(ctx, user.ID, userAgent, ipAddress)
 	if err != nil {
-		svc.logger.Error("failed to create token",
+		svc.log(ctx).Error("failed to create session",
+			zap.String("user_id", user.ID),
+			zap.Error(err))
+		return nil, fmt.Errorf("create session: %w", err)
+	}
+
+	token, err := utils.CreateToken(svc.keys, user.ID, user.Email, user.Username, sessionID, user.Roles, svc.tokens.AccessTTL)
+	if err != nil {
+		svc.log(ctx).Error("failed to create token",
 			zap.String("user_id", user.ID),
 			zap.Error(err))
 		return nil, fmt.Errorf("create token: %w", err)
 	}
 
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("create refresh token: %w", err)
+	}
+	if err = svc.store.CreateRefreshToken(ctx, user.ID, sessionID, refreshHash, time.Now().Add(svc.tokens.RefreshTTL)); err != nil {
+		svc.log(ctx).Error("failed to store refresh token",
+			zap.String("user_id", user.ID),
+			zap.Error(err))
+		return nil, fmt.Errorf("create refresh token: %w", err)
+	}
+
 	return &pb.AuthUserResponse{
-		Token: token,
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(svc.tokens.AccessTTL.Seconds()),
+	}, nil
+}
+
+func (svc *Service) RefreshToken(ctx context.Context, p *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	if p == nil || p.GetRefreshToken() == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("create refresh token: %w", err)
+	}
+
+	user, sessionID, err := svc.store.RotateRefreshToken(ctx, hashRefreshToken(p.GetRefreshToken()), refreshHash, time.Now().Add(svc.tokens.RefreshTTL))
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			svc.log(ctx).Warn("refresh token reused, token family revoked")
+		}
+		return nil, fmt.Errorf("rotate refresh token: %w", err)
+	}
+
+	token, err := utils.CreateToken(svc.keys, user.ID, user.Email, user.Username, sessionID, user.Roles, svc.tokens.AccessTTL)
+	if err != nil {
+		svc.log(ctx).Error("failed to create token",
+			zap.String("user_id", user.ID),
+			zap.Error(err))
+		return nil, fmt.Errorf("create token: %w", err)
+	}
+
+	return &pb.RefreshTokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(svc.tokens.AccessTTL.Seconds()),
 	}, nil
 }
 
+func (svc *Service) Logout(ctx context.Context, p *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	if p == nil || p.GetToken() == "" {
+		return nil, ErrInvalidToken
+	}
+
+	claims, err := utils.ParseToken(svc.keys, p.GetToken())
+	if err != nil || claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if err = svc.store.RevokeToken(ctx, claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+		svc.log(ctx).Error("failed to revoke token",
+			zap.String("user_id", claims.UserID),
+			zap.Error(err))
+		return nil, fmt.Errorf("revoke token: %w", err)
+	}
+
+	if p.GetRefreshToken() != "" {
+		if err = svc.store.RevokeRefreshTokenFamily(ctx, claims.UserID, hashRefreshToken(p.GetRefreshToken())); err != nil {
+			svc.log(ctx).Error("failed to revoke refresh token",
+				zap.String("user_id", claims.UserID),
+				zap.Error(err))
+			return nil, fmt.Errorf("revoke refresh token: %w", err)
+		}
+	}
+
+	if claims.SessionID != "" {
+		err = svc.store.RevokeSession(ctx, claims.UserID, claims.SessionID, time.Now().Add(svc.tokens.AccessTTL))
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			svc.log(ctx).Error("failed to revoke session",
+				zap.String("user_id", claims.UserID),
+				zap.Error(err))
+			return nil, fmt.Errorf("revoke session: %w", err)
+		}
+	}
+
+	svc.notifyRevocation(ctx)
+
+	return &pb.LogoutResponse{
+		Success:   true,
+		TokenId:   claims.ID,
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	}, nil
+}
+
+func (svc *Service) ListRevokedTokens(ctx context.Context, p *pb.ListRevokedTokensRequest) (*pb.ListRevokedTokensResponse, error) {
+	tokens, err := svc.store.ListRevokedTokens(ctx, time.UnixMilli(p.GetSince()))
+	if err != nil {
+		svc.log(ctx).Error("failed to list revoked tokens", zap.Error(err))
+		return nil, fmt.Errorf("list revoked tokens: %w", err)
+	}
+
+	resp := &pb.ListRevokedTokensResponse{Tokens: make([]*pb.RevokedToken, 0, len(tokens))}
+	for _, token := range tokens {
+		resp.Tokens = append(resp.Tokens, &pb.RevokedToken{
+			TokenId:   token.TokenID,
+			ExpiresAt: token.ExpiresAt.Unix(),
+			RevokedAt: token.RevokedAt.UnixMilli(),
+		})
+	}
+
+	return resp, nil
+}
+
+func (svc *Service) ListSessions(ctx context.Context, p *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := auth.AuthorizeUser(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+
+	// A session whose refresh token has expired cannot be resumed, so it is
+	// no longer worth showing.
+	sessions, err := svc.store.ListSessions(ctx, p.GetUserId(), time.Now().Add(-svc.tokens.RefreshTTL))
+	if err != nil {
+		svc.log(ctx).Error("failed to list sessions",
+			zap.String("user_id", p.GetUserId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+
+	resp := &pb.ListSessionsResponse{Sessions: make([]*pb.Session, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			SessionId:  session.ID,
+			UserAgent:  session.UserAgent,
+			IpAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt.Unix(),
+			LastSeenAt: session.LastSeenAt.Unix(),
+		})
+	}
+
+	return resp, nil
+}
+
+func (svc *Service) RevokeSession(ctx context.Context, p *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := auth.AuthorizeUser(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+	if p.GetSessionId() == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	err := svc.store.RevokeSession(ctx, p.GetUserId(), p.GetSessionId(), time.Now().Add(svc.tokens.AccessTTL))
+	if err != nil {
+		svc.log(ctx).Warn("failed to revoke session",
+			zap.String("user_id", p.GetUserId()),
+			zap.String("session_id", p.GetSessionId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("revoke session: %w", err)
+	}
+
+	svc.notifyRevocation(ctx)
+
+	return &pb.RevokeSessionResponse{Success: true}, nil
+}
+
+func (svc *Service) RevokeOtherSessions(ctx context.Context, p *pb.RevokeOtherSessionsRequest) (*pb.RevokeOtherSessionsResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := auth.AuthorizeUser(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+
+	revoked, err := svc.store.RevokeOtherSessions(ctx, p.GetUserId(), p.GetCurrentSessionId(), time.Now().Add(svc.tokens.AccessTTL))
+	if err != nil {
+		svc.log(ctx).Error("failed to revoke other sessions",
+			zap.String("user_id", p.GetUserId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("revoke other sessions: %w", err)
+	}
+
+	if revoked > 0 {
+		svc.notifyRevocation(ctx)
+	}
+
+	return &pb.RevokeOtherSessionsResponse{Revoked: revoked}, nil
+}
+
+// notifyRevocation bumps the revocations key so verifiers resync their
+// denylists. Failure only delays propagation until their next poll.
+func (svc *Service) notifyRevocation(ctx context.Context) {
+	if svc.kv == nil {
+		return
+	}
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := svc.kv.PutKey(ctx, auth.RevocationsKey, value); err != nil {
+		svc.log(ctx).Warn("failed to broadcast token revocation", zap.Error(err))
+	}
+}
+
 func (svc *Service) GetUser(ctx context.Context, p *pb.GetUserRequest) (*pb.GetUserResponse, error) {
 	if p == nil || p.GetUserId() == "" {
 		return nil, ErrEmptyUserID
 	}
+	if err := auth.AuthorizeUserOrRole(ctx, p.GetUserId(), auth.RoleAdmin); err != nil {
+		return nil, err
+	}
 
 	user, err := svc.store.GetUser(ctx, p.GetUserId())
 	if err != nil {
-		svc.logger.Warn("failed to get user",
+		svc.log(ctx).Warn("failed to get user",
 			zap.String("user_id", p.GetUserId()),
 			zap.Error(err))
 		return nil, fmt.Errorf("get user: %w", err)
@@ -92,6 +828,7 @@ func (svc *Service) GetUser(ctx context.Context, p *pb.GetUserRequest) (*pb.GetU
 		UserId:   user.ID,
 		Username: user.Username,
 		Email:    user.Email,
+		Roles:    user.Roles,
 	}, nil
 }
 
@@ -99,17 +836,312 @@ func (svc *Service) DeleteUser(ctx context.Context, p *pb.DeleteUserRequest) (*p
 	if p == nil || p.GetUserId() == "" {
 		return nil, ErrEmptyUserID
 	}
+	if err := auth.AuthorizeUserOrRole(ctx, p.GetUserId(), auth.RoleAdmin); err != nil {
+		return nil, err
+	}
 
-	err := svc.store.DeleteUser(ctx, p.GetUserId())
+	err := svc.store.DeleteUser(ctx, p.GetUserId(), time.Now().Add(svc.tokens.AccessTTL))
 	if err != nil {
-		svc.logger.Warn("failed to delete user",
+		svc.log(ctx).Warn("failed to delete user",
 			zap.String("user_id", p.GetUserId()),
 			zap.Error(err))
 		return nil, fmt.Errorf("delete user: %w", err)
 	}
 
+	svc.notifyRevocation(ctx)
+
 	return &pb.DeleteUserResponse{
 		Success: true,
 		Message: "user deleted",
 	}, nil
 }
+
+func (svc *Service) ListUsers(ctx context.Context, p *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	if err := auth.AuthorizeRole(ctx, auth.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	limit := int(p.GetLimit())
+	if limit <= 0 || limit > maxListUsersLimit {
+		limit = maxListUsersLimit
+	}
+	offset := max(int(p.GetOffset()), 0)
+
+	users, err := svc.store.ListUsers(ctx, limit, offset)
+	if err != nil {
+		svc.log(ctx).Error("failed to list users", zap.Error(err))
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+
+	resp := &pb.ListUsersResponse{Users: make([]*pb.UserSummary, 0, len(users))}
+	for _, user := range users {
+		summary := &pb.UserSummary{
+			UserId:    user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			Roles:     user.Roles,
+			CreatedAt: user.CreatedAt.Unix(),
+		}
+		if user.SuspendedAt != nil {
+			summary.SuspendedAt = user.SuspendedAt.Unix()
+		}
+		resp.Users = append(resp.Users, summary)
+	}
+
+	return resp, nil
+}
+
+func (svc *Service) SetUserSuspended(ctx context.Context, p *pb.SetUserSuspendedRequest) (*pb.SetUserSuspendedResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := auth.AuthorizeRole(ctx, auth.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	err := svc.store.SetUserSuspended(ctx, p.GetUserId(), p.GetSuspended(), time.Now().Add(svc.tokens.AccessTTL))
+	if err != nil {
+		svc.log(ctx).Warn("failed to change user suspension",
+			zap.String("user_id", p.GetUserId()),
+			zap.Bool("suspended", p.GetSuspended()),
+			zap.Error(err))
+		return nil, fmt.Errorf("set user suspended: %w", err)
+	}
+
+	svc.log(ctx).Info("user suspension changed",
+		zap.String("user_id", p.GetUserId()),
+		zap.Bool("suspended", p.GetSuspended()),
+		zap.String("admin_id", auth.FromContext(ctx).UserID))
+
+	if p.GetSuspended() {
+		svc.notifyRevocation(ctx)
+	}
+
+	return &pb.SetUserSuspendedResponse{Success: true}, nil
+}
+
+func (svc *Service) GetJWKS(_ context.Context, _ *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	set := svc.keys.JWKS()
+
+	keys := make([]*pb.JSONWebKey, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		keys = append(keys, &pb.JSONWebKey{
+			Kid: key.KeyID,
+			Kty: key.KeyType,
+			Alg: key.Algorithm,
+			Use: key.Use,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Curve,
+			X:   key.X,
+		})
+	}
+
+	return &pb.GetJWKSResponse{Keys: keys}, nil
+}
+
+func (svc *Service) IssueServiceToken(ctx context.Context, p *pb.IssueServiceTokenRequest) (*pb.IssueServiceTokenResponse, error) {
+	identity := svc.serviceTokens.Identity
+	if identity == nil {
+		return nil, ErrServiceTokensDisabled
+	}
+	if p == nil || p.GetClientId() == "" || p.GetAudience() == "" {
+		return nil, ErrEmptyValues
+	}
+
+	if !mtls.PeerHasName(ctx, p.GetClientId()) && !svc.validClientSecret(p.GetClientId(), p.GetClientSecret()) {
+		svc.log(ctx).Warn("rejected service token request",
+			zap.String("client_id", p.GetClientId()),
+			zap.String("audience", p.GetAudience()))
+		return nil, ErrInvalidServiceClient
+	}
+
+	token, _, err := identity.Issue(p.GetClientId(), p.GetAudience())
+	if err != nil {
+		svc.log(ctx).Error("failed to issue service token",
+			zap.String("client_id", p.GetClientId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("issue service token: %w", err)
+	}
+
+	return &pb.IssueServiceTokenResponse{
+		Token:     token,
+		ExpiresIn: int64(identity.TTL().Seconds()),
+	}, nil
+}
+
+func (svc *Service) CreatePersonalAccessToken(ctx context.Context, p *pb.CreatePersonalAccessTokenRequest) (*pb.CreatePersonalAccessTokenResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+	if p.GetName() == "" {
+		return nil, ErrEmptyValues
+	}
+	if len(p.GetScopes()) == 0 {
+		return nil, ErrInvalidScopes
+	}
+	for _, scope := range p.GetScopes() {
+		if !auth.ValidScope(scope) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScopes, scope)
+		}
+	}
+
+	ttl := time.Duration(p.GetExpiresIn()) * time.Second
+	if ttl <= 0 {
+		ttl = defaultPersonalAccessTokenTTL
+	}
+	ttl = min(ttl, maxPersonalAccessTokenTTL)
+	expiresAt := time.Now().Add(ttl)
+
+	token, tokenHash, err := newPersonalAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("create personal access token: %w", err)
+	}
+
+	tokenID, err := svc.store.CreatePersonalAccessToken(ctx, p.GetUserId(), p.GetName(), tokenHash, p.GetScopes(), expiresAt)
+	if err != nil {
+		svc.log(ctx).Error("failed to create personal access token",
+			zap.String("user_id", p.GetUserId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("create personal access token: %w", err)
+	}
+
+	return &pb.CreatePersonalAccessTokenResponse{
+		TokenId:   tokenID,
+		Token:     token,
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+func (svc *Service) ListPersonalAccessTokens(ctx context.Context, p *pb.ListPersonalAccessTokensRequest) (*pb.ListPersonalAccessTokensResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+
+	tokens, err := svc.store.ListPersonalAccessTokens(ctx, p.GetUserId())
+	if err != nil {
+		svc.log(ctx).Error("failed to list personal access tokens",
+			zap.String("user_id", p.GetUserId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("list personal access tokens: %w", err)
+	}
+
+	resp := &pb.ListPersonalAccessTokensResponse{Tokens: make([]*pb.PersonalAccessToken, 0, len(tokens))}
+	for _, token := range tokens {
+		item := &pb.PersonalAccessToken{
+			TokenId:   token.ID,
+			Name:      token.Name,
+			Scopes:    token.Scopes,
+			CreatedAt: token.CreatedAt.Unix(),
+			ExpiresAt: token.ExpiresAt.Unix(),
+		}
+		if token.LastUsedAt != nil {
+			item.LastUsedAt = token.LastUsedAt.Unix()
+		}
+		resp.Tokens = append(resp.Tokens, item)
+	}
+
+	return resp, nil
+}
+
+func (svc *Service) RevokePersonalAccessToken(ctx context.Context, p *pb.RevokePersonalAccessTokenRequest) (*pb.RevokePersonalAccessTokenResponse, error) {
+	if p == nil || p.GetUserId() == "" {
+		return nil, ErrEmptyUserID
+	}
+	if err := authorizeAccountChange(ctx, p.GetUserId()); err != nil {
+		return nil, err
+	}
+	if p.GetTokenId() == "" {
+		return nil, ErrPersonalAccessTokenNotFound
+	}
+
+	err := svc.store.RevokePersonalAccessToken(ctx, p.GetUserId(), p.GetTokenId(), time.Now().Add(svc.tokens.AccessTTL))
+	if err != nil {
+		svc.log(ctx).Warn("failed to revoke personal access token",
+			zap.String("user_id", p.GetUserId()),
+			zap.String("token_id", p.GetTokenId()),
+			zap.Error(err))
+		return nil, fmt.Errorf("revoke personal access token: %w", err)
+	}
+
+	svc.notifyRevocation(ctx)
+
+	return &pb.RevokePersonalAccessTokenResponse{Success: true}, nil
+}
+
+// ExchangePersonalAccessToken issues an access token limited to the personal
+// access token's scopes, so that services verify it like any other.
+func (svc *Service) ExchangePersonalAccessToken(ctx context.Context, p *pb.ExchangePersonalAccessTokenRequest) (*pb.ExchangePersonalAccessTokenResponse, error) {
+	if p == nil || !auth.IsPersonalAccessToken(p.GetToken()) {
+		return nil, ErrInvalidPersonalAccessToken
+	}
+
+	token, user, err := svc.store.UsePersonalAccessToken(ctx, hashRefreshToken(p.GetToken()))
+	if err != nil {
+		return nil, fmt.Errorf("use personal access token: %w", err)
+	}
+
+	ttl := min(svc.tokens.AccessTTL, time.Until(token.ExpiresAt))
+	accessToken, err := utils.CreateScopedToken(svc.keys, user.ID, user.Email, user.Username, token.ID, token.Scopes, ttl)
+	if err != nil {
+		svc.log(ctx).Error("failed to create token",
+			zap.String("user_id", user.ID),
+			zap.Error(err))
+		return nil, fmt.Errorf("create token: %w", err)
+	}
+
+	return &pb.ExchangePersonalAccessTokenResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   int64(ttl.Seconds()),
+	}, nil
+}
+
+// authorizeAccountChange is auth.AuthorizeUser, additionally keeping a
+// personal access token from being used to change the account, such as its
+// password or other tokens.
+func authorizeAccountChange(ctx context.Context, userID string) error {
+	if err := auth.AuthorizeUser(ctx, userID); err != nil {
+		return err
+	}
+	if len(auth.FromContext(ctx).Scopes) > 0 {
+		return fmt.Errorf("%w: personal access tokens cannot change the account", auth.ErrPermissionDenied)
+	}
+	return nil
+}
+
+func (svc *Service) validClientSecret(clientID, secret string) bool {
+	expected, ok := svc.serviceTokens.Clients[clientID]
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) == 1
+}
+
+// newRefreshToken returns an opaque token for the client and the hash stored
+// in its place, so a database leak does not yield usable tokens.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func newPersonalAccessToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := auth.PersonalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+// hashRefreshToken hashes refresh and personal access tokens for storage.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
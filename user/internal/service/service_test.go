@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/HJyup/mtl-common/api"
+	"github.com/HJyup/mtl-common/auth"
+	"go.uber.org/zap"
+)
+
+// fakeStore keeps one user and the failed sign-ins counted against accounts,
+// locking them as the real store does. Methods a test does not need are left
+// to the nil Store and panic if called.
+type fakeStore struct {
+	Store
+
+	user     *User
+	password string
+
+	// totp is the user's enrolment, if any, and recoveryCodes the hashes of
+	// their unused recovery codes.
+	totp          *TOTP
+	recoveryCodes map[string]bool
+
+	failures    map[string]int
+	lockedUntil map[string]time.Time
+	// passwordChecks counts the current passwords ChangePassword compared.
+	passwordChecks int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		user:          &User{ID: "user-1", Username: "user", Email: "user@example.com"},
+		password:      "current password",
+		recoveryCodes: make(map[string]bool),
+		failures:      make(map[string]int),
+		lockedUntil:   make(map[string]time.Time),
+	}
+}
+
+func (s *fakeStore) GetUser(_ context.Context, id string) (*User, error) {
+	if id != s.user.ID {
+		return nil, ErrUserNotFound
+	}
+	return s.user, nil
+}
+
+func (s *fakeStore) LoginLockedUntil(_ context.Context, email, _ string) (time.Time, error) {
+	return s.lockedUntil[email], nil
+}
+
+func (s *fakeStore) RecordLoginFailure(_ context.Context, email, _ string, config LoginConfig) (time.Time, error) {
+	s.failures[email]++
+	if delay := config.Account.LockDuration(s.failures[email]); delay > 0 {
+		s.lockedUntil[email] = time.Now().Add(delay)
+	}
+	return s.lockedUntil[email], nil
+}
+
+func (s *fakeStore) ClearLoginFailures(_ context.Context, email string) error {
+	delete(s.failures, email)
+	delete(s.lockedUntil, email)
+	return nil
+}
+
+func (s *fakeStore) ChangePassword(_ context.Context, userID, currentPassword, newPassword, _ string, _ time.Time) (int64, error) {
+	if userID != s.user.ID {
+		return 0, ErrUserNotFound
+	}
+	s.passwordChecks++
+	if currentPassword != s.password {
+		return 0, ErrInvalidPassword
+	}
+	s.password = newPassword
+	return 0, nil
+}
+
+func (s *fakeStore) GetTOTP(_ context.Context, userID string) (*TOTP, error) {
+	if userID != s.user.ID || s.totp == nil {
+		return nil, ErrMFANotEnrolled
+	}
+	return s.totp, nil
+}
+
+func (s *fakeStore) DisableTOTP(_ context.Context, userID string, _ int64, recoveryCodeHash string) error {
+	if userID != s.user.ID || s.totp == nil {
+		return ErrMFANotEnrolled
+	}
+	if recoveryCodeHash == "" || !s.recoveryCodes[recoveryCodeHash] {
+		return ErrInvalidMFACode
+	}
+	s.totp = nil
+	return nil
+}
+
+func newTestService(store Store) *Service {
+	return NewService(store, zap.NewNop(), Config{
+		Tokens: TokenConfig{AccessTTL: time.Minute, RefreshTTL: time.Hour},
+	})
+}
+
+// userContext authenticates the request as the user, as a session token would.
+func userContext(user *User) context.Context {
+	return auth.NewContext(context.Background(), &auth.Principal{UserID: user.ID, SessionID: "session-1"})
+}
+
+func TestChangePasswordLocksOutGuessing(t *testing.T) {
+	store := newFakeStore()
+	svc := newTestService(store)
+	ctx := userContext(store.user)
+
+	for i := range DefaultAccountLockout.Threshold {
+		_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+			UserId:          store.user.ID,
+			CurrentPassword: "wrong password",
+			NewPassword:     "new password",
+		})
+		if !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("guess %d: error = %v, want %v", i+1, err, ErrInvalidPassword)
+		}
+	}
+
+	// Even the right password is refused while the account is locked.
+	_, err := svc.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		UserId:          store.user.ID,
+		CurrentPassword: store.password,
+		NewPassword:     "new password",
+	})
+	if !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("error = %v, want %v", err, ErrLoginLocked)
+	}
+	if store.passwordChecks != DefaultAccountLockout.Threshold {
+		t.Errorf("current password checked %d times, want %d", store.passwordChecks, DefaultAccountLockout.Threshold)
+	}
+	if store.password != "current password" {
+		t.Error("password changed during the lockout")
+	}
+}
@@ -4,73 +4,418 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/HJyup/mlt-user/internal/passhash"
 	"github.com/HJyup/mlt-user/internal/service"
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	loginScopeAccount = "account"
+	loginScopeIP      = "ip"
+
+	// uniqueViolation is the Postgres error code for a broken unique
+	// constraint.
+	uniqueViolation = "23505"
+)
+
+// upgradePasswordTimeout bounds a rehash, which outlives the sign-in request.
+const upgradePasswordTimeout = 30 * time.Second
+
+var passwordHashSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "user_password_hash_duration_seconds",
+	Help:    "Time spent hashing passwords, by operation.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+}, []string{"operation"})
+
+var passwordRehashes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "user_password_rehashes_total",
+	Help: "Outdated password hashes replaced at sign-in, by result.",
+}, []string{"result"})
+
 type Store struct {
-	dbConn *pgx.Conn
+	dbConn *pgxpool.Pool
+	hasher *passhash.Hasher
+	// dummyPasswordHash is verified when there is no password to check, so
+	// that a sign-in takes as long whether or not the account exists.
+	dummyPasswordHash func() string
 }
 
-func NewStore(dbConn *pgx.Conn) *Store {
-	return &Store{dbConn: dbConn}
+func NewStore(dbConn *pgxpool.Pool, hasher *passhash.Hasher) *Store {
+	s := &Store{dbConn: dbConn, hasher: hasher}
+	s.dummyPasswordHash = sync.OnceValue(func() string {
+		hashedPassword, _ := s.hashPassword(context.Background(), "dummy password")
+		return hashedPassword
+	})
+	return s
 }
 
-func (s *Store) CreateUser(ctx context.Context, username, email, password string) (string, error) {
+func (s *Store) CreateUser(ctx context.Context, username, email, password string, verification *service.EmailToken) (string, error) {
 	var existingID string
 	err := s.dbConn.QueryRow(ctx, "SELECT id FROM users WHERE email = $1", email).Scan(&existingID)
 	if err == nil {
-		return "", errors.New("user with this email already exists")
+		return "", service.ErrEmailTaken
 	} else if !errors.Is(err, pgx.ErrNoRows) {
 		return "", fmt.Errorf("error checking existing user: %w", err)
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := s.hashPassword(ctx, password)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash password: %w", err)
+		return "", err
+	}
+
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
 	var userID string
-	err = s.dbConn.QueryRow(ctx,
+	err = tx.QueryRow(ctx,
 		"INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id",
-		username, email, string(hashedPassword)).Scan(&userID)
+		username, email, hashedPassword).Scan(&userID)
 	if err != nil {
+		// Another sign-up took the email since it was checked.
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return "", service.ErrEmailTaken
+		}
 		return "", fmt.Errorf("failed to create user: %w", err)
 	}
 
+	if err = createEmailVerification(ctx, tx, userID, verification); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// CreateEmailVerification issues a new verification for the unverified user
+// with email, returning service.ErrUserNotFound if there is none and
+// service.ErrVerificationTooSoon if one was issued after notSince.
+func (s *Store) CreateEmailVerification(ctx context.Context, email string, verification *service.EmailToken, notSince time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx,
+		"SELECT id FROM users WHERE email = $1 AND email_verified_at IS NULL FOR UPDATE",
+		email).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return service.ErrUserNotFound
+		}
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+
+	var recent bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM email_verification_tokens WHERE user_id = $1 AND created_at > $2)",
+		userID, notSince).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("failed to query verification tokens: %w", err)
+	}
+	if recent {
+		return service.ErrVerificationTooSoon
+	}
+
+	if err = createEmailVerification(ctx, tx, userID, verification); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyEmail uses up a verification token and marks its user's email
+// verified, returning the user's ID.
+func (s *Store) VerifyEmail(ctx context.Context, tokenHash string) (string, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx,
+		`UPDATE email_verification_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`,
+		tokenHash).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", service.ErrInvalidVerificationToken
+		}
+		return "", fmt.Errorf("failed to use verification token: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1",
+		userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
 	return userID, nil
 }
 
+func createEmailVerification(ctx context.Context, tx pgx.Tx, userID string, verification *service.EmailToken) error {
+	_, err := tx.Exec(ctx,
+		"INSERT INTO email_verification_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, verification.TokenHash, verification.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create verification token: %w", err)
+	}
+
+	return enqueueMessage(ctx, tx, verification.Message)
+}
+
+func enqueueMessage(ctx context.Context, tx pgx.Tx, msg *service.OutboxMessage) error {
+	_, err := tx.Exec(ctx,
+		"INSERT INTO outbox (recipient, subject, body) VALUES ($1, $2, $3)",
+		msg.To, msg.Subject, msg.Body)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue message: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) ClaimOutboxMessages(ctx context.Context, limit, maxAttempts int, lease time.Duration) ([]*service.OutboxMessage, error) {
+	rows, err := s.dbConn.Query(ctx,
+		`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = now() + $3 * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND next_attempt_at <= now() AND attempts < $2
+			ORDER BY id LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, subject, body, attempts`,
+		limit, maxAttempts, lease.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*service.OutboxMessage
+	for rows.Next() {
+		msg := &service.OutboxMessage{}
+		if err = rows.Scan(&msg.ID, &msg.To, &msg.Subject, &msg.Body, &msg.Attempts); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+func (s *Store) MarkOutboxMessageSent(ctx context.Context, id int64) error {
+	_, err := s.dbConn.Exec(ctx,
+		"UPDATE outbox SET sent_at = now(), body = '', last_error = NULL WHERE id = $1",
+		id)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox message sent: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, nextAttemptAt time.Time) error {
+	_, err := s.dbConn.Exec(ctx,
+		"UPDATE outbox SET last_error = $2, next_attempt_at = $3 WHERE id = $1",
+		id, reason, nextAttemptAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox message failed: %w", err)
+	}
+
+	return nil
+}
+
 func (s *Store) AuthUser(ctx context.Context, email, password string) (*service.User, error) {
 	user := &service.User{Email: email}
-	var hashedPassword string
+	var hashedPassword *string
 
-	err := s.dbConn.QueryRow(ctx, "SELECT id, username, password FROM users WHERE email = $1", email).Scan(&user.ID, &user.Username, &hashedPassword)
+	var emailVerifiedAt *time.Time
+
+	err := s.dbConn.QueryRow(ctx,
+		`SELECT id, username, password, roles, suspended_at, email_verified_at,
+			EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = users.id AND t.confirmed_at IS NOT NULL)
+		FROM users WHERE email = $1`,
+		email).Scan(&user.ID, &user.Username, &hashedPassword, &user.Roles, &user.SuspendedAt, &emailVerifiedAt, &user.MFAEnabled)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, errors.New("user not found")
+			_, _, _ = s.verifyPassword(ctx, s.dummyPasswordHash(), password)
+			return nil, service.ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("failed to query user: %w", err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	// Users created through an identity provider have no password.
+	if hashedPassword == nil {
+		_, _, _ = s.verifyPassword(ctx, s.dummyPasswordHash(), password)
+		return nil, service.ErrInvalidCredentials
+	}
+
+	match, rehash, err := s.verifyPassword(ctx, *hashedPassword, password)
 	if err != nil {
-		return nil, errors.New("invalid password")
+		return nil, err
+	}
+	if !match {
+		return nil, service.ErrInvalidCredentials
+	}
+	if rehash {
+		// In the background, so that accounts with outdated hashes do not
+		// take longer to sign in.
+		go s.upgradePassword(context.WithoutCancel(ctx), user.ID, *hashedPassword, password)
+	}
+	// Checked only after the password, so suspension does not reveal that an
+	// account exists.
+	if user.SuspendedAt != nil {
+		return nil, service.ErrUserSuspended
+	}
+	if emailVerifiedAt == nil {
+		return nil, service.ErrEmailNotVerified
 	}
 
 	return user, nil
 }
 
+func (s *Store) LoginLockedUntil(ctx context.Context, email, ipAddress string) (time.Time, error) {
+	var lockedUntil *time.Time
+
+	err := s.dbConn.QueryRow(ctx,
+		`SELECT max(locked_until) FROM login_attempts
+		WHERE (scope = $1 AND key = lower($2)) OR (scope = $3 AND key = $4)`,
+		loginScopeAccount, email, loginScopeIP, ipAddress).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query login attempts: %w", err)
+	}
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+
+	return *lockedUntil, nil
+}
+
+func (s *Store) RecordLoginFailure(ctx context.Context, email, ipAddress string, config service.LoginConfig) (time.Time, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	type attempt struct {
+		scope  string
+		key    string
+		policy service.LockoutPolicy
+	}
+	attempts := []attempt{{loginScopeAccount, strings.ToLower(email), config.Account}}
+	// Calls from trusted services may not carry a client IP.
+	if ipAddress != "" {
+		attempts = append(attempts, attempt{loginScopeIP, ipAddress, config.IP})
+	}
+
+	now := time.Now()
+	var lockedUntil time.Time
+	for _, a := range attempts {
+		var failures int
+		err = tx.QueryRow(ctx,
+			`INSERT INTO login_attempts (scope, key, failures, last_failure_at) VALUES ($1, $2, 1, $3)
+			ON CONFLICT (scope, key) DO UPDATE SET
+				failures = CASE WHEN login_attempts.last_failure_at < $4 THEN 1 ELSE login_attempts.failures + 1 END,
+				last_failure_at = EXCLUDED.last_failure_at
+			RETURNING failures`,
+			a.scope, a.key, now, now.Add(-config.Window)).Scan(&failures)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to record login failure: %w", err)
+		}
+
+		lockDuration := a.policy.LockDuration(failures)
+		if lockDuration <= 0 {
+			continue
+		}
+		until := now.Add(lockDuration)
+		_, err = tx.Exec(ctx,
+			"UPDATE login_attempts SET locked_until = $3 WHERE scope = $1 AND key = $2",
+			a.scope, a.key, until)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to lock login: %w", err)
+		}
+		if until.After(lockedUntil) {
+			lockedUntil = until
+		}
+	}
+
+	// Forgotten failures no longer count; prune them as new ones come in.
+	_, err = tx.Exec(ctx,
+		"DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)",
+		now.Add(-config.Window), now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to prune login attempts: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return lockedUntil, nil
+}
+
+func (s *Store) ClearLoginFailures(ctx context.Context, email string) error {
+	_, err := s.dbConn.Exec(ctx,
+		"DELETE FROM login_attempts WHERE scope = $1 AND key = lower($2)",
+		loginScopeAccount, email)
+	if err != nil {
+		return fmt.Errorf("failed to clear login attempts: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) UnlockUser(ctx context.Context, userID string) error {
+	var email string
+	err := s.dbConn.QueryRow(ctx, "SELECT email FROM users WHERE id::text = $1", userID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return service.ErrUserNotFound
+		}
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+
+	return s.ClearLoginFailures(ctx, email)
+}
+
 func (s *Store) GetUser(ctx context.Context, userID string) (*service.User, error) {
 	user := &service.User{}
 
 	err := s.dbConn.QueryRow(ctx,
-		"SELECT id, username, email FROM users WHERE id = $1",
-		userID).Scan(&user.ID, &user.Username, &user.Email)
+		"SELECT id, username, email, roles, created_at, suspended_at FROM users WHERE id::text = $1",
+		userID).Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.CreatedAt, &user.SuspendedAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, errors.New("user not found")
+			return nil, service.ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -78,15 +423,944 @@ func (s *Store) GetUser(ctx context.Context, userID string) (*service.User, erro
 	return user, nil
 }
 
-func (s *Store) DeleteUser(ctx context.Context, userID string) error {
-	result, err := s.dbConn.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+func (s *Store) DeleteUser(ctx context.Context, userID string, deniedUntil time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Deleting the user drops their sessions and personal access tokens, but
+	// not the access tokens already issued for them.
+	if _, err = revokeSessionsExcept(ctx, tx, userID, "", deniedUntil); err != nil {
+		return err
+	}
+	if err = denyPersonalAccessTokens(ctx, tx, userID, deniedUntil); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, "DELETE FROM users WHERE id::text = $1", userID)
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
+	if result.RowsAffected() == 0 {
+		return service.ErrUserNotFound
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) CreateRefreshToken(ctx context.Context, userID, sessionID, tokenHash string, expiresAt time.Time) error {
+	_, err := s.dbConn.Exec(ctx,
+		"INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, sessionID, tokenHash, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*service.User, string, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		tokenID, userID, familyID string
+		tokenExpiresAt            time.Time
+		rotatedAt, revokedAt      *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT id, user_id, family_id, expires_at, rotated_at, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE",
+		tokenHash).Scan(&tokenID, &userID, &familyID, &tokenExpiresAt, &rotatedAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", service.ErrInvalidRefreshToken
+		}
+		return nil, "", fmt.Errorf("failed to query refresh token: %w", err)
+	}
+
+	if rotatedAt != nil {
+		_, err = tx.Exec(ctx,
+			"UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL",
+			familyID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to revoke token family: %w", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, "", service.ErrRefreshTokenReused
+	}
+	if revokedAt != nil || time.Now().After(tokenExpiresAt) {
+		return nil, "", service.ErrInvalidRefreshToken
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE refresh_tokens SET rotated_at = now() WHERE id = $1", tokenID); err != nil {
+		return nil, "", fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if _, err = tx.Exec(ctx, "UPDATE sessions SET last_seen_at = now() WHERE id = $1", familyID); err != nil {
+		return nil, "", fmt.Errorf("failed to touch session: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, familyID, newTokenHash, expiresAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	user := &service.User{}
+	err = tx.QueryRow(ctx,
+		"SELECT id, username, email, roles, suspended_at FROM users WHERE id = $1",
+		userID).Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.SuspendedAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.SuspendedAt != nil {
+		return nil, "", service.ErrUserSuspended
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return user, familyID, nil
+}
+
+func (s *Store) RevokeRefreshTokenFamily(ctx context.Context, userID, tokenHash string) error {
+	_, err := s.dbConn.Exec(ctx,
+		`UPDATE refresh_tokens SET revoked_at = now()
+		WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id::text = $2) AND revoked_at IS NULL`,
+		tokenHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) RevokeToken(ctx context.Context, tokenID, userID string, expiresAt time.Time) error {
+	_, err := s.dbConn.Exec(ctx,
+		"INSERT INTO revoked_tokens (token_id, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (token_id) DO NOTHING",
+		tokenID, userID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	// Expired rows no longer deny anything; prune them as revocations come in.
+	if _, err = s.dbConn.Exec(ctx, "DELETE FROM revoked_tokens WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) ListRevokedTokens(ctx context.Context, since time.Time) ([]*service.RevokedToken, error) {
+	rows, err := s.dbConn.Query(ctx,
+		"SELECT token_id, expires_at, revoked_at FROM revoked_tokens WHERE revoked_at > $1 AND expires_at > now()",
+		since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*service.RevokedToken
+	for rows.Next() {
+		token := &service.RevokedToken{}
+		if err = rows.Scan(&token.TokenID, &token.ExpiresAt, &token.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revoked token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list revoked tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func (s *Store) CreateSession(ctx context.Context, userID, userAgent, ipAddress string) (string, error) {
+	var sessionID string
+	err := s.dbConn.QueryRow(ctx,
+		"INSERT INTO sessions (user_id, user_agent, ip_address) VALUES ($1, $2, $3) RETURNING id",
+		userID, userAgent, ipAddress).Scan(&sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return sessionID, nil
+}
+
+func (s *Store) ListSessions(ctx context.Context, userID string, seenSince time.Time) ([]*service.Session, error) {
+	rows, err := s.dbConn.Query(ctx,
+		`SELECT id, user_agent, ip_address, created_at, last_seen_at FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND last_seen_at > $2
+		ORDER BY last_seen_at DESC`,
+		userID, seenSince)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*service.Session
+	for rows.Next() {
+		session := &service.Session{}
+		if err = rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+func (s *Store) RevokeSession(ctx context.Context, userID, sessionID string, deniedUntil time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Compared as text so a malformed ID is simply not found.
+	result, err := tx.Exec(ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND id::text = $2 AND revoked_at IS NULL",
+		userID, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrSessionNotFound
+	}
+
+	if err = revokeSessions(ctx, tx, userID, []string{sessionID}, deniedUntil); err != nil {
+		return err
+	}
 
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
-		return errors.New("user not found")
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string, deniedUntil time.Time) (int64, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	revoked, err := revokeSessionsExcept(ctx, tx, userID, keepSessionID, deniedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return revoked, nil
+}
+
+func (s *Store) ListUsers(ctx context.Context, limit, offset int) ([]*service.User, error) {
+	rows, err := s.dbConn.Query(ctx,
+		`SELECT id, username, email, roles, created_at, suspended_at FROM users
+		ORDER BY created_at, id LIMIT $1 OFFSET $2`,
+		limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*service.User
+	for rows.Next() {
+		user := &service.User{}
+		if err = rows.Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.CreatedAt, &user.SuspendedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	return users, nil
+}
+
+func (s *Store) SetUserSuspended(ctx context.Context, userID string, suspended bool, deniedUntil time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"UPDATE users SET suspended_at = CASE WHEN $2 THEN COALESCE(suspended_at, now()) END WHERE id::text = $1",
+		userID, suspended)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrUserNotFound
+	}
+
+	if suspended {
+		if _, err = revokeSessionsExcept(ctx, tx, userID, "", deniedUntil); err != nil {
+			return err
+		}
+		if err = denyPersonalAccessTokens(ctx, tx, userID, deniedUntil); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) CreatePersonalAccessToken(ctx context.Context, userID, name, tokenHash string, scopes []string, expiresAt time.Time) (string, error) {
+	var tokenID string
+	err := s.dbConn.QueryRow(ctx,
+		`INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		userID, name, tokenHash, scopes, expiresAt).Scan(&tokenID)
+	if err != nil {
+		return "", fmt.Errorf("failed to create personal access token: %w", err)
+	}
+
+	return tokenID, nil
+}
+
+func (s *Store) ListPersonalAccessTokens(ctx context.Context, userID string) ([]*service.PersonalAccessToken, error) {
+	rows, err := s.dbConn.Query(ctx,
+		`SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY created_at DESC`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list personal access tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*service.PersonalAccessToken
+	for rows.Next() {
+		token := &service.PersonalAccessToken{}
+		if err = rows.Scan(&token.ID, &token.UserID, &token.Name, &token.Scopes, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan personal access token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list personal access tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func (s *Store) RevokePersonalAccessToken(ctx context.Context, userID, tokenID string, deniedUntil time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"UPDATE personal_access_tokens SET revoked_at = now() WHERE user_id = $1 AND id::text = $2 AND revoked_at IS NULL",
+		userID, tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke personal access token: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrPersonalAccessTokenNotFound
+	}
+
+	// Access tokens exchanged for it carry its ID as their sid.
+	_, err = tx.Exec(ctx,
+		"INSERT INTO revoked_tokens (token_id, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (token_id) DO NOTHING",
+		tokenID, userID, deniedUntil)
+	if err != nil {
+		return fmt.Errorf("failed to deny personal access token: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// UsePersonalAccessToken returns the token with the given hash and its owner,
+// provided it is still active and the owner is not suspended.
+func (s *Store) UsePersonalAccessToken(ctx context.Context, tokenHash string) (*service.PersonalAccessToken, *service.User, error) {
+	token := &service.PersonalAccessToken{}
+	user := &service.User{}
+	var revokedAt *time.Time
+
+	err := s.dbConn.QueryRow(ctx,
+		`UPDATE personal_access_tokens t SET last_used_at = now()
+		FROM users u
+		WHERE t.token_hash = $1 AND u.id = t.user_id
+		RETURNING t.id, t.name, t.scopes, t.created_at, t.expires_at, t.revoked_at, u.id, u.username, u.email, u.suspended_at`,
+		tokenHash).Scan(&token.ID, &token.Name, &token.Scopes, &token.CreatedAt, &token.ExpiresAt, &revokedAt,
+		&user.ID, &user.Username, &user.Email, &user.SuspendedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, service.ErrInvalidPersonalAccessToken
+		}
+		return nil, nil, fmt.Errorf("failed to query personal access token: %w", err)
+	}
+	if revokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, nil, service.ErrInvalidPersonalAccessToken
+	}
+	if user.SuspendedAt != nil {
+		return nil, nil, service.ErrUserSuspended
+	}
+	token.UserID = user.ID
+
+	return token, user, nil
+}
+
+// AuthIdentity returns the user the identity is linked to. An unknown identity
+// is linked to the user with the same email, or to a new user without a
+// password, but only if the provider verified the email.
+func (s *Store) AuthIdentity(ctx context.Context, identity *service.Identity) (*service.User, bool, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	user := &service.User{}
+	created := false
+
+	err = tx.QueryRow(ctx,
+		`UPDATE user_identities i SET email = $3, last_login_at = now()
+		FROM users u
+		WHERE i.provider = $1 AND i.subject = $2 AND u.id = i.user_id
+		RETURNING u.id, u.username, u.email, u.roles, u.suspended_at`,
+		identity.Provider, identity.Subject, identity.Email).Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.SuspendedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, fmt.Errorf("failed to query identity: %w", err)
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		if !identity.EmailVerified {
+			return nil, false, service.ErrIdentityEmailNotVerified
+		}
+
+		var emailVerifiedAt *time.Time
+		err = tx.QueryRow(ctx,
+			"SELECT id, username, email, roles, suspended_at, email_verified_at FROM users WHERE lower(email) = lower($1) FOR UPDATE",
+			identity.Email).Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.SuspendedAt, &emailVerifiedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			created = true
+			err = tx.QueryRow(ctx,
+				"INSERT INTO users (username, email, email_verified_at) VALUES ($1, $2, now()) RETURNING id, username, email, roles",
+				identity.Username, identity.Email).Scan(&user.ID, &user.Username, &user.Email, &user.Roles)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to find user for identity: %w", err)
+		}
+
+		// Whoever signed up with an unverified email may not own it. The
+		// provider has proven who does, so the unverified account's password
+		// is dropped before linking; it never had a session to revoke.
+		if !created && emailVerifiedAt == nil {
+			_, err = tx.Exec(ctx,
+				"UPDATE users SET password = NULL, email_verified_at = now() WHERE id = $1",
+				user.ID)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to claim unverified user: %w", err)
+			}
+		}
+
+		_, err = tx.Exec(ctx,
+			"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+			user.ID, identity.Provider, identity.Subject, identity.Email)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to link identity: %w", err)
+		}
+	}
+
+	if user.SuspendedAt != nil {
+		return nil, false, service.ErrUserSuspended
+	}
+
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id::text = $1 AND confirmed_at IS NOT NULL)",
+		user.ID).Scan(&user.MFAEnabled)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query mfa: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return user, created, nil
+}
+
+// denyPersonalAccessTokens denies the access tokens already exchanged for the
+// user's personal access tokens, without revoking the tokens themselves.
+func denyPersonalAccessTokens(ctx context.Context, tx pgx.Tx, userID string, deniedUntil time.Time) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO revoked_tokens (token_id, user_id, expires_at)
+		SELECT id::text, user_id, $2 FROM personal_access_tokens
+		WHERE user_id::text = $1 AND revoked_at IS NULL AND expires_at > now()
+		ON CONFLICT (token_id) DO NOTHING`,
+		userID, deniedUntil)
+	if err != nil {
+		return fmt.Errorf("failed to deny personal access tokens: %w", err)
+	}
+
+	return nil
+}
+
+// ChangePassword replaces the user's password if currentPassword matches, and
+// revokes every other session, returning how many were revoked.
+func (s *Store) ChangePassword(ctx context.Context, userID, currentPassword, newPassword, keepSessionID string, deniedUntil time.Time) (int64, error) {
+	hashedPassword, err := s.hashPassword(ctx, newPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var currentHash *string
+	err = tx.QueryRow(ctx, "SELECT password FROM users WHERE id::text = $1 FOR UPDATE", userID).Scan(&currentHash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, service.ErrUserNotFound
+		}
+		return 0, fmt.Errorf("failed to query user: %w", err)
+	}
+	// A user created through an identity provider sets a first password by
+	// resetting it.
+	if currentHash == nil {
+		return 0, service.ErrInvalidPassword
+	}
+	if match, _, err := s.verifyPassword(ctx, *currentHash, currentPassword); err != nil {
+		return 0, err
+	} else if !match {
+		return 0, service.ErrInvalidPassword
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE users SET password = $2 WHERE id::text = $1", userID, hashedPassword); err != nil {
+		return 0, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	revoked, err := revokeSessionsExcept(ctx, tx, userID, keepSessionID, deniedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return revoked, nil
+}
+
+// CreatePasswordReset issues a reset token for the user with email, returning
+// service.ErrUserNotFound if there is none and service.ErrPasswordResetTooSoon
+// if one was issued after notSince.
+func (s *Store) CreatePasswordReset(ctx context.Context, email string, reset *service.EmailToken, notSince time.Time) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, "SELECT id FROM users WHERE email = $1 FOR UPDATE", email).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return service.ErrUserNotFound
+		}
+		return fmt.Errorf("failed to query user: %w", err)
+	}
+
+	var recent bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM password_reset_tokens WHERE user_id = $1 AND created_at > $2)",
+		userID, notSince).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("failed to query password reset tokens: %w", err)
+	}
+	if recent {
+		return service.ErrPasswordResetTooSoon
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, reset.TokenHash, reset.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create password reset token: %w", err)
+	}
+	if err = enqueueMessage(ctx, tx, reset.Message); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword uses up a reset token and sets its user's password, revoking
+// all of the user's sessions and outstanding reset tokens. The email that
+// delivered the token proves the user owns the address, so it is also marked
+// verified. It returns the user's ID.
+func (s *Store) ResetPassword(ctx context.Context, tokenHash, newPassword string, deniedUntil time.Time) (string, error) {
+	hashedPassword, err := s.hashPassword(ctx, newPassword)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx,
+		`UPDATE password_reset_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`,
+		tokenHash).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", service.ErrInvalidPasswordResetToken
+		}
+		return "", fmt.Errorf("failed to use password reset token: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE password_reset_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL",
+		userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to revoke password reset tokens: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET password = $2, email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1",
+		userID, hashedPassword)
+	if err != nil {
+		return "", fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if _, err = revokeSessionsExcept(ctx, tx, userID, "", deniedUntil); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// SetPendingTOTP stores a TOTP secret awaiting confirmation, replacing any
+// earlier unconfirmed one.
+func (s *Store) SetPendingTOTP(ctx context.Context, userID, secret string) error {
+	result, err := s.dbConn.Exec(ctx,
+		`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+		WHERE user_totp.confirmed_at IS NULL`,
+		userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to store totp secret: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrMFAAlreadyEnabled
+	}
+	return nil
+}
+
+func (s *Store) GetTOTP(ctx context.Context, userID string) (*service.TOTP, error) {
+	totp := &service.TOTP{}
+
+	err := s.dbConn.QueryRow(ctx,
+		"SELECT secret, last_used_step, confirmed_at FROM user_totp WHERE user_id::text = $1",
+		userID).Scan(&totp.Secret, &totp.LastUsedStep, &totp.ConfirmedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, service.ErrMFANotEnrolled
+		}
+		return nil, fmt.Errorf("failed to query totp: %w", err)
+	}
+
+	return totp, nil
+}
+
+// ConfirmTOTP enables the user's pending TOTP secret, recording step as used,
+// and replaces their recovery codes.
+func (s *Store) ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"UPDATE user_totp SET confirmed_at = now(), last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL",
+		userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to confirm totp: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrMFANotEnrolled
+	}
+
+	if _, err = tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO mfa_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])",
+		userID, recoveryCodeHashes)
+	if err != nil {
+		return fmt.Errorf("failed to create recovery codes: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DisableTOTP removes the user's TOTP secret and recovery codes, provided the
+// TOTP step or recovery code has not been used before.
+func (s *Store) DisableTOTP(ctx context.Context, userID string, step int64, recoveryCodeHash string) error {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = useMFACode(ctx, tx, userID, step, recoveryCodeHash); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("failed to delete totp: %w", err)
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) CreateMFAChallenge(ctx context.Context, userID, tokenHash, userAgent, ipAddress string, expiresAt time.Time) error {
+	_, err := s.dbConn.Exec(ctx,
+		"INSERT INTO mfa_challenges (user_id, token_hash, user_agent, ip_address, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		userID, tokenHash, userAgent, ipAddress, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create mfa challenge: %w", err)
+	}
+	return nil
+}
+
+// AttemptMFAChallenge counts an attempt at an open challenge and returns it
+// with its user's TOTP enrolment, as long as fewer than maxAttempts were made.
+func (s *Store) AttemptMFAChallenge(ctx context.Context, tokenHash string, maxAttempts int) (*service.MFAChallenge, error) {
+	challenge := &service.MFAChallenge{TOTP: &service.TOTP{}}
+
+	err := s.dbConn.QueryRow(ctx,
+		`UPDATE mfa_challenges c SET attempts = c.attempts + 1
+		FROM user_totp t, users u
+		WHERE c.token_hash = $1 AND c.used_at IS NULL AND c.expires_at > now() AND c.attempts < $2
+			AND t.user_id = c.user_id AND t.confirmed_at IS NOT NULL AND u.id = c.user_id
+		RETURNING c.id, c.user_id, u.email, c.user_agent, c.ip_address, t.secret, t.last_used_step, t.confirmed_at`,
+		tokenHash, maxAttempts).Scan(&challenge.ID, &challenge.UserID, &challenge.Email, &challenge.UserAgent, &challenge.IPAddress,
+		&challenge.TOTP.Secret, &challenge.TOTP.LastUsedStep, &challenge.TOTP.ConfirmedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, service.ErrInvalidMFAChallenge
+		}
+		return nil, fmt.Errorf("failed to attempt mfa challenge: %w", err)
+	}
+
+	return challenge, nil
+}
+
+// CompleteMFAChallenge closes the challenge, recording the TOTP step or using
+// up the recovery code that answered it, and returns the user signing in.
+func (s *Store) CompleteMFAChallenge(ctx context.Context, challengeID, userID string, step int64, recoveryCodeHash string) (*service.User, error) {
+	tx, err := s.dbConn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"UPDATE mfa_challenges SET used_at = now() WHERE id = $1 AND used_at IS NULL",
+		challengeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete mfa challenge: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, service.ErrInvalidMFAChallenge
+	}
+
+	if err = useMFACode(ctx, tx, userID, step, recoveryCodeHash); err != nil {
+		return nil, err
+	}
+
+	user := &service.User{}
+	err = tx.QueryRow(ctx,
+		"SELECT id, username, email, roles, suspended_at FROM users WHERE id = $1",
+		userID).Scan(&user.ID, &user.Username, &user.Email, &user.Roles, &user.SuspendedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	if user.SuspendedAt != nil {
+		return nil, service.ErrUserSuspended
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return user, nil
+}
+
+// useMFACode records a TOTP step as used, or uses up a recovery code if
+// recoveryCodeHash is set, returning service.ErrInvalidMFACode if either was
+// used before.
+func useMFACode(ctx context.Context, tx pgx.Tx, userID string, step int64, recoveryCodeHash string) error {
+	var err error
+	var result pgconn.CommandTag
+	if recoveryCodeHash != "" {
+		result, err = tx.Exec(ctx,
+			"UPDATE mfa_recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+			userID, recoveryCodeHash)
+	} else {
+		result, err = tx.Exec(ctx,
+			"UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2",
+			userID, step)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to use mfa code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return service.ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (s *Store) hashPassword(ctx context.Context, password string) (string, error) {
+	start := time.Now()
+	hashedPassword, err := s.hasher.Hash(ctx, password)
+	passwordHashSeconds.WithLabelValues("generate").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return hashedPassword, nil
+}
+
+// verifyPassword reports whether password matches hashedPassword, and whether
+// the hash should be upgraded.
+func (s *Store) verifyPassword(ctx context.Context, hashedPassword, password string) (bool, bool, error) {
+	start := time.Now()
+	match, rehash, err := s.hasher.Verify(ctx, hashedPassword, password)
+	passwordHashSeconds.WithLabelValues("compare").Observe(time.Since(start).Seconds())
+	if errors.Is(err, passhash.ErrUnknownKey) {
+		// The pepper was retired, so the password can no longer be checked
+		// and has to be reset.
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to verify password: %w", err)
+	}
+	return match, rehash, nil
+}
+
+// upgradePassword replaces a hash made with an older algorithm or weaker
+// parameters, unless the password was changed meanwhile. Failing leaves the
+// old hash in place until the next sign-in.
+func (s *Store) upgradePassword(ctx context.Context, userID, oldHash, password string) {
+	ctx, cancel := context.WithTimeout(ctx, upgradePasswordTimeout)
+	defer cancel()
+
+	hashedPassword, err := s.hashPassword(ctx, password)
+	if err == nil {
+		_, err = s.dbConn.Exec(ctx,
+			"UPDATE users SET password = $3 WHERE id = $1 AND password = $2",
+			userID, oldHash, hashedPassword)
+	}
+	if err != nil {
+		passwordRehashes.WithLabelValues("error").Inc()
+		return
+	}
+	passwordRehashes.WithLabelValues("success").Inc()
+}
+
+// revokeSessionsExcept revokes every active session of the user but keepSessionID,
+// which may be empty, and returns how many were revoked.
+func revokeSessionsExcept(ctx context.Context, tx pgx.Tx, userID, keepSessionID string, deniedUntil time.Time) (int64, error) {
+	rows, err := tx.Query(ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND id::text <> $2 AND revoked_at IS NULL RETURNING id::text",
+		userID, keepSessionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	sessionIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	if err = revokeSessions(ctx, tx, userID, sessionIDs, deniedUntil); err != nil {
+		return 0, err
+	}
+
+	return int64(len(sessionIDs)), nil
+}
+
+// revokeSessions revokes the refresh token families of sessions that were just
+// marked revoked, and denies the session IDs at the gateway.
+func revokeSessions(ctx context.Context, tx pgx.Tx, userID string, sessionIDs []string, deniedUntil time.Time) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx,
+		"UPDATE refresh_tokens SET revoked_at = now() WHERE family_id::text = ANY($1) AND revoked_at IS NULL",
+		sessionIDs)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session refresh tokens: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO revoked_tokens (token_id, user_id, expires_at)
+		SELECT unnest($1::text[]), $2, $3
+		ON CONFLICT (token_id) DO NOTHING`,
+		sessionIDs, userID, deniedUntil)
+	if err != nil {
+		return fmt.Errorf("failed to deny sessions: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,79 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateRFC6238Vectors(t *testing.T) {
+	// The SHA1 vectors of RFC 6238 appendix B, cut to six digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := Validate(rfcSecret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("Validate(%q) at %d rejected", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / 30; step != want {
+			t.Errorf("Validate(%q) at %d step = %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 005924 belongs to the step of 1234567890, which starts at 1234567890.
+	const code = "005924"
+	issued := time.Unix(1234567890, 0)
+	step := issued.Unix() / 30
+
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{name: "one period late", at: issued.Add(Period), ok: true},
+		{name: "one period early", at: issued.Add(-Period), ok: true},
+		{name: "two periods late", at: issued.Add(2 * Period), ok: false},
+		{name: "two periods early", at: issued.Add(-2 * Period), ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(rfcSecret, code, tt.at)
+			if ok != tt.ok {
+				t.Fatalf("Validate ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && got != step {
+				t.Errorf("Validate step = %d, want the step the code was issued for, %d", got, step)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedInput(t *testing.T) {
+	at := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, "28708", at); ok {
+		t.Error("Validate accepted a five digit code")
+	}
+	if _, ok := Validate("not base32!", "287082", at); ok {
+		t.Error("Validate accepted an invalid secret")
+	}
+	if _, ok := Validate("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", at); !ok {
+		t.Error("Validate rejected a lower case secret")
+	}
+}
@@ -0,0 +1,8 @@
+-- Roles are copied into the roles claim of access tokens, so a change takes
+-- effect on the user's next sign in or refresh. There is no API to grant
+-- roles; promote an operator directly:
+--   UPDATE users SET roles = array_append(roles, 'admin') WHERE email = '...';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{}';
+
+-- Suspended users can neither sign in nor refresh their tokens.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;
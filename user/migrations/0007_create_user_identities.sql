@@ -0,0 +1,16 @@
+-- Identities at external OpenID Connect providers, keyed by the provider's
+-- subject identifier. A user signing in only through a provider has no password.
+CREATE TABLE IF NOT EXISTS user_identities (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider      TEXT NOT NULL,
+    subject       TEXT NOT NULL,
+    email         TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_login_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+ALTER TABLE users ALTER COLUMN password DROP NOT NULL;
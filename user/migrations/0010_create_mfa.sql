@@ -0,0 +1,38 @@
+-- TOTP two-factor authentication. The secret is encrypted with the service's
+-- MFA key, and is pending until the user confirms it with a first code.
+-- last_used_step keeps a code from being accepted twice.
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id        UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret         TEXT NOT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    confirmed_at   TIMESTAMPTZ
+);
+
+-- One-time recovery codes, for when the authenticator is lost. Only the
+-- SHA-256 of each code is stored.
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash  TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at    TIMESTAMPTZ,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Challenges issued by a password sign-in for a user with MFA, completed by
+-- VerifyMFA. Only the SHA-256 of the challenge token is stored, and the
+-- attempts made on it are limited.
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    attempts   INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS mfa_challenges_user_id_idx ON mfa_challenges (user_id);
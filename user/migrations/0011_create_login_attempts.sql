@@ -0,0 +1,14 @@
+-- Failed password sign-ins, counted per account and per client IP. The account
+-- key is the lowercased email as typed, whether or not it is registered, so a
+-- lockout does not reveal which emails are. Counts start over once the last
+-- failure is older than the lockout window.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope           TEXT NOT NULL,
+    key             TEXT NOT NULL,
+    failures        INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until    TIMESTAMPTZ,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_last_failure_at_idx ON login_attempts (last_failure_at);